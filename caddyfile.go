@@ -16,6 +16,10 @@ package scgi
 
 import (
 	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -39,7 +43,30 @@ func init() {
 //	    dial_timeout <duration>
 //	    read_timeout <duration>
 //	    write_timeout <duration>
-//	    capture_stderr
+//	    capture_stderr [<header>]
+//	    max_spool_size <size>
+//	    deny_headers <fields...>
+//	    underscore_headers drop|reject|allow
+//	    conn_pool {
+//	        min_idle <n>
+//	        max_idle <n>
+//	        idle_timeout <duration>
+//	    }
+//	    max_conns_per_upstream <n>
+//	    max_queue_size <n>
+//	    queue_timeout <duration>
+//	    max_local_redirects <n>
+//	    sendfile_root <path>
+//	    response_mode cgi|nph|auto
+//	    max_response_header_bytes <size>
+//	    health_check {
+//	        script_name <path>
+//	        request_uri <uri>
+//	        method <method>
+//	        env <key> <value>
+//	        expect_status <code>
+//	        expect_body <regexp>
+//	    }
 //	}
 func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // consume transport name
@@ -104,11 +131,113 @@ func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			t.WriteTimeout = caddy.Duration(dur)
 
 		case "capture_stderr":
+			if d.NextArg() {
+				t.StderrHeader = d.Val()
+			}
 			if d.NextArg() {
 				return d.ArgErr()
 			}
 			t.CaptureStderr = true
 
+		case "max_spool_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid byte size '%s': %v", d.Val(), err)
+			}
+			t.MaxSpoolSize = int64(size)
+
+		case "deny_headers":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			t.DenyHeaders = append(t.DenyHeaders, args...)
+
+		case "underscore_headers":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.UnderscoreHeaders = d.Val()
+
+		case "conn_pool":
+			pool, err := unmarshalConnPool(d)
+			if err != nil {
+				return err
+			}
+			t.ConnPool = pool
+
+		case "max_conns_per_upstream":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("bad max_conns_per_upstream value %s: %v", d.Val(), err)
+			}
+			t.MaxConnsPerUpstream = n
+
+		case "max_queue_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("bad max_queue_size value %s: %v", d.Val(), err)
+			}
+			t.MaxQueueSize = n
+
+		case "queue_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("bad timeout value %s: %v", d.Val(), err)
+			}
+			t.QueueTimeout = caddy.Duration(dur)
+
+		case "max_local_redirects":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("bad max_local_redirects value %s: %v", d.Val(), err)
+			}
+			t.MaxLocalRedirects = n
+
+		case "sendfile_root":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.SendfileRoot = d.Val()
+
+		case "response_mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ResponseMode = d.Val()
+
+		case "max_response_header_bytes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return d.Errf("invalid byte size '%s': %v", d.Val(), err)
+			}
+			t.MaxResponseHeaderBytes = int64(size)
+
+		case "health_check":
+			hc, err := unmarshalHealthCheck(d)
+			if err != nil {
+				return err
+			}
+			t.HealthCheck = hc
+
 		default:
 			return d.Errf("unrecognized subdirective %s", d.Val())
 		}
@@ -116,6 +245,133 @@ func (t *Transport) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// unmarshalConnPool deserializes a conn_pool block, starting
+// at the subdirective name:
+//
+//	conn_pool {
+//	    min_idle <n>
+//	    max_idle <n>
+//	    idle_timeout <duration>
+//	}
+func unmarshalConnPool(d *caddyfile.Dispenser) (*ConnPool, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	pool := new(ConnPool)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "min_idle":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("bad min_idle value %s: %v", d.Val(), err)
+			}
+			pool.MinIdle = n
+
+		case "max_idle":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("bad max_idle value %s: %v", d.Val(), err)
+			}
+			pool.MaxIdle = n
+
+		case "idle_timeout":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("bad timeout value %s: %v", d.Val(), err)
+			}
+			pool.IdleTimeout = caddy.Duration(dur)
+
+		default:
+			return nil, d.Errf("unrecognized conn_pool option %s", d.Val())
+		}
+	}
+	return pool, nil
+}
+
+// unmarshalHealthCheck deserializes a health_check block, starting
+// at the subdirective name:
+//
+//	health_check {
+//	    script_name <path>
+//	    request_uri <uri>
+//	    method <method>
+//	    env <key> <value>
+//	    expect_status <code>
+//	    expect_body <regexp>
+//	}
+func unmarshalHealthCheck(d *caddyfile.Dispenser) (*HealthCheck, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	hc := new(HealthCheck)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "script_name":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			hc.ScriptName = d.Val()
+
+		case "request_uri":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			hc.RequestURI = d.Val()
+
+		case "method":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			hc.Method = d.Val()
+
+		case "env":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			if hc.EnvVars == nil {
+				hc.EnvVars = make(map[string]string)
+			}
+			hc.EnvVars[args[0]] = args[1]
+
+		case "expect_status":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			val := d.Val()
+			if len(val) == 3 && strings.HasSuffix(val, "xx") {
+				val = val[:1]
+			}
+			code, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, d.Errf("bad expect_status value %s: %v", d.Val(), err)
+			}
+			hc.ExpectStatus = code
+
+		case "expect_body":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			hc.ExpectBody = d.Val()
+
+		default:
+			return nil, d.Errf("unrecognized health_check option %s", d.Val())
+		}
+	}
+	return hc, nil
+}
+
 // parseSCGI parses the scgi directive, which has the same syntax
 // as the reverse_proxy directive (in fact, the reverse_proxy's directive
 // Unmarshaler is invoked by this function). A line such as this:
@@ -247,7 +503,130 @@ func parseSCGI(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
 			case "capture_stderr":
 				args := dispenser.RemainingArgs()
 				dispenser.DeleteN(len(args) + 1)
+				if len(args) > 1 {
+					return nil, dispenser.ArgErr()
+				}
+				if len(args) == 1 {
+					scgiTransport.StderrHeader = args[0]
+				}
 				scgiTransport.CaptureStderr = true
+
+			case "max_spool_size":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				size, err := humanize.ParseBytes(dispenser.Val())
+				if err != nil {
+					return nil, dispenser.Errf("invalid byte size '%s': %v", dispenser.Val(), err)
+				}
+				scgiTransport.MaxSpoolSize = int64(size)
+				dispenser.DeleteN(2)
+
+			case "deny_headers":
+				args := dispenser.RemainingArgs()
+				dispenser.DeleteN(len(args) + 1)
+				if len(args) == 0 {
+					return nil, dispenser.ArgErr()
+				}
+				scgiTransport.DenyHeaders = append(scgiTransport.DenyHeaders, args...)
+
+			case "underscore_headers":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				scgiTransport.UnderscoreHeaders = dispenser.Val()
+				dispenser.DeleteN(2)
+
+			case "conn_pool":
+				segment := dispenser.NextSegment()
+				dispenser.DeleteN(len(segment))
+				d := caddyfile.NewDispenser(segment)
+				d.Next() // consume subdirective name
+				pool, err := unmarshalConnPool(d)
+				if err != nil {
+					return nil, err
+				}
+				scgiTransport.ConnPool = pool
+
+			case "max_conns_per_upstream":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				n, err := strconv.Atoi(dispenser.Val())
+				if err != nil {
+					return nil, dispenser.Errf("bad max_conns_per_upstream value %s: %v", dispenser.Val(), err)
+				}
+				scgiTransport.MaxConnsPerUpstream = n
+				dispenser.DeleteN(2)
+
+			case "max_queue_size":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				n, err := strconv.Atoi(dispenser.Val())
+				if err != nil {
+					return nil, dispenser.Errf("bad max_queue_size value %s: %v", dispenser.Val(), err)
+				}
+				scgiTransport.MaxQueueSize = n
+				dispenser.DeleteN(2)
+
+			case "queue_timeout":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(dispenser.Val())
+				if err != nil {
+					return nil, dispenser.Errf("bad timeout value %s: %v", dispenser.Val(), err)
+				}
+				scgiTransport.QueueTimeout = caddy.Duration(dur)
+				dispenser.DeleteN(2)
+
+			case "max_local_redirects":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				n, err := strconv.Atoi(dispenser.Val())
+				if err != nil {
+					return nil, dispenser.Errf("bad max_local_redirects value %s: %v", dispenser.Val(), err)
+				}
+				scgiTransport.MaxLocalRedirects = n
+				dispenser.DeleteN(2)
+
+			case "sendfile_root":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				scgiTransport.SendfileRoot = dispenser.Val()
+				dispenser.DeleteN(2)
+
+			case "response_mode":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				scgiTransport.ResponseMode = dispenser.Val()
+				dispenser.DeleteN(2)
+
+			case "max_response_header_bytes":
+				if !dispenser.NextArg() {
+					return nil, dispenser.ArgErr()
+				}
+				size, err := humanize.ParseBytes(dispenser.Val())
+				if err != nil {
+					return nil, dispenser.Errf("invalid byte size '%s': %v", dispenser.Val(), err)
+				}
+				scgiTransport.MaxResponseHeaderBytes = int64(size)
+				dispenser.DeleteN(2)
+
+			case "health_check":
+				segment := dispenser.NextSegment()
+				dispenser.DeleteN(len(segment))
+				d := caddyfile.NewDispenser(segment)
+				d.Next() // consume subdirective name
+				hc, err := unmarshalHealthCheck(d)
+				if err != nil {
+					return nil, err
+				}
+				scgiTransport.HealthCheck = hc
 			}
 		}
 	}
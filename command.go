@@ -0,0 +1,245 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+
+	"github.com/Elegant996/scgi-transport/scgi"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "scgi-request",
+		Usage: `--dial <address> [--method <method>] [--uri <uri>] [--host <host>] [--root <path>] [--split <substrings...>] [--header "Field: value"] [--env <key>=<value>] [--data <data>|@<file>] [--response-mode cgi|nph|auto] [--timeout <duration>] [--dump-request [--dump-hex]]`,
+		Short: "Sends a single request to an SCGI server and prints the response",
+		Long: `
+Sends a single request to the SCGI server at the --dial address and prints
+the response's status line, header fields and body. Useful for debugging
+SCGI backends without a running Caddy.
+
+The address is a network address as used by the reverse_proxy's upstreams,
+e.g. localhost:7777 or unix//run/app.sock.
+
+The environment is built the same way as by the scgi transport, from the
+request given by --method, --uri, --host and --header, and the transport
+options --root and --split. Extra variables may be set by repeating --env.
+The response is parsed the same way as by the transport, according to
+--response-mode. --timeout limits how long reading and writing may take.
+
+The request body is given by --data, either literally or, prefixed with @,
+as the name of a file to read it from; @- reads it from stdin.
+
+--dump-request prints the exact bytes sent to the SCGI server to stderr
+as they are written, before the response is read. With --dump-hex, they
+are printed as a hex dump instead.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().String("dial", "", "Address of the SCGI server")
+			cmd.Flags().StringP("method", "X", http.MethodGet, "Request method")
+			cmd.Flags().String("uri", "/", "Request URI, i.e. a path with an optional query")
+			cmd.Flags().String("host", "localhost", "Host of the request")
+			cmd.Flags().String("root", ".", "Root directory of SCRIPT_FILENAME")
+			cmd.Flags().StringSlice("split", []string{}, "Substrings on which to split the path into SCRIPT_NAME and PATH_INFO")
+			cmd.Flags().StringArrayP("header", "H", []string{}, "Set a request header (format: \"Field: value\")")
+			cmd.Flags().StringArrayP("env", "e", []string{}, "Set an environment variable (format: key=value)")
+			cmd.Flags().StringP("data", "d", "", "Request body, or @<file> to read it from a file")
+			cmd.Flags().String("response-mode", scgi.ResponseModeAuto, "How the response is parsed: cgi, nph or auto")
+			cmd.Flags().Duration("timeout", 0, "Timeout for reading and writing; 0 means none")
+			cmd.Flags().Bool("dump-request", false, "Print the bytes sent to the SCGI server to stderr")
+			cmd.Flags().Bool("dump-hex", false, "Print the --dump-request bytes as a hex dump")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdSCGIRequest)
+		},
+	})
+}
+
+func cmdSCGIRequest(fs caddycmd.Flags) (int, error) {
+	dial := fs.String("dial")
+	uri := fs.String("uri")
+	data := fs.String("data")
+	responseMode := fs.String("response-mode")
+	timeout := fs.Duration("timeout")
+	dumpRequest := fs.Bool("dump-request")
+	dumpHex := fs.Bool("dump-hex")
+
+	if dial == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--dial is required")
+	}
+	addr, err := caddy.ParseNetworkAddress(dial)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid dial address %s: %v", dial, err)
+	}
+	if addr.PortRangeSize() != 1 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("dial address must be a single address: %s", dial)
+	}
+
+	if !strings.HasPrefix(uri, "/") {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("uri must begin with /: %s", uri)
+	}
+
+	switch responseMode {
+	case scgi.ResponseModeCGI, scgi.ResponseModeNPH, scgi.ResponseModeAuto:
+	default:
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unrecognized response mode: %s", responseMode)
+	}
+
+	split, err := fs.GetStringSlice("split")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid split flag: %v", err)
+	}
+
+	// the transport builds the environment, just like it does for proxied requests
+	transport := &Transport{
+		Root:      fs.String("root"),
+		SplitPath: split,
+	}
+	envFlags, err := fs.GetStringArray("env")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid env flag: %v", err)
+	}
+	for _, kv := range envFlags {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("env must be in key=value format: %s", kv)
+		}
+		if transport.EnvVars == nil {
+			transport.EnvVars = make(map[string]string)
+		}
+		transport.EnvVars[key] = value
+	}
+	if err := transport.provisionEnv(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var body io.Reader
+	switch {
+	case data == "@-":
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("reading request body from stdin: %v", err)
+		}
+		body = bytes.NewReader(b)
+	case strings.HasPrefix(data, "@"):
+		b, err := os.ReadFile(data[1:])
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("reading request body: %v", err)
+		}
+		body = bytes.NewReader(b)
+	case data != "":
+		body = strings.NewReader(data)
+	}
+
+	req, err := http.NewRequest(fs.String("method"), "http://"+fs.String("host")+uri, body)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("making request: %v", err)
+	}
+	headers, err := fs.GetStringArray("header")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid header flag: %v", err)
+	}
+	for _, h := range headers {
+		field, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("header must be in \"Field: value\" format: %s", h)
+		}
+		req.Header.Add(strings.TrimSpace(field), strings.TrimSpace(value))
+	}
+
+	client := &scgi.Client{
+		Network:      addr.Network,
+		Address:      addr.JoinHostPort(0),
+		DialTimeout:  3 * time.Second,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		ResponseMode: responseMode,
+		Env: func(r *http.Request) (map[string]string, error) {
+			ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+			ctx = context.WithValue(ctx, caddyhttp.OriginalRequestCtxKey, *r)
+			return transport.buildEnv(r.WithContext(ctx))
+		},
+	}
+	if dumpRequest {
+		var dump io.Writer = os.Stderr
+		if dumpHex {
+			// the dumper holds back a partial last line until it is
+			// closed, so close it once the request has been written
+			dumper := hex.Dumper(os.Stderr)
+			defer dumper.Close()
+			dump = dumper
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+				WroteRequest: func(httptrace.WroteRequestInfo) { dumper.Close() },
+			}))
+		}
+		dialer := &net.Dialer{Timeout: client.DialTimeout}
+		client.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return dumpConn{Conn: conn, w: dump}, nil
+		}
+	}
+
+	resp, err := client.RoundTrip(req)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+
+	fmt.Printf("%s %s\r\n", resp.Proto, resp.Status)
+	if err := resp.Header.Write(os.Stdout); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Print("\r\n")
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("reading response body: %v", err)
+	}
+	if len(resp.Trailer) > 0 {
+		fmt.Print("\r\n")
+		if err := resp.Trailer.Write(os.Stdout); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// dumpConn is a connection that copies everything written to it to w.
+type dumpConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c dumpConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.w.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,335 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ConnPool configures a pool of pre-established idle connections to each
+// upstream, so requests don't have to wait for a connection handshake.
+// SCGI closes the connection after every response, so a pooled connection
+// is handed to exactly one request and never returned to the pool.
+//
+// The pool of an upstream that goes unused for 5 minutes, or IdleTimeout
+// if longer, is closed, so upstreams that were removed or only dialed
+// dynamically don't keep connections open.
+type ConnPool struct {
+	// The minimum number of idle connections kept open to each upstream.
+	// Default: `1`.
+	MinIdle int `json:"min_idle,omitempty"`
+
+	// The maximum number of idle connections kept open to each upstream.
+	// The pool grows towards this whenever a request finds it empty, and
+	// shrinks back towards MinIdle as idle connections time out.
+	// Default: MinIdle.
+	MaxIdle int `json:"max_idle,omitempty"`
+
+	// How long a connection may sit idle in the pool before it is closed
+	// and replaced. This should be lower than any idle timeout enforced by
+	// the upstream. Default: `30s`.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+}
+
+// unusedPoolTimeout is how long a pool may go without being taken
+// from before it is evicted, unless the idle timeout is longer.
+const unusedPoolTimeout = 5 * time.Minute
+
+// connPools holds a pool of idle connections for each upstream
+// that has been dialed, keyed by network and address.
+type connPools struct {
+	cfg        ConnPool
+	dialer     net.Dialer
+	logger     *zap.Logger
+	evictAfter time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	pools map[string]*connPool
+}
+
+func newConnPools(cfg ConnPool, dialTimeout time.Duration, logger *zap.Logger) *connPools {
+	if cfg.MinIdle <= 0 {
+		cfg.MinIdle = 1
+	}
+	if cfg.MaxIdle < cfg.MinIdle {
+		cfg.MaxIdle = cfg.MinIdle
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = caddy.Duration(30 * time.Second)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connPools{
+		cfg:        cfg,
+		dialer:     net.Dialer{Timeout: dialTimeout},
+		logger:     logger,
+		evictAfter: max(unusedPoolTimeout, time.Duration(cfg.IdleTimeout)),
+		ctx:        ctx,
+		cancel:     cancel,
+		pools:      make(map[string]*connPool),
+	}
+}
+
+// DialContext returns an idle connection to address from its pool if one
+// is available, otherwise it dials a new one.
+func (p *connPools) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if conn := p.pool(network, address).take(); conn != nil {
+		return conn, nil
+	}
+	return p.dialer.DialContext(ctx, network, address)
+}
+
+// pool returns the pool for address, creating and starting it if needed.
+func (p *connPools) pool(network, address string) *connPool {
+	key := network + "/" + address
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pool, ok := p.pools[key]
+	if !ok {
+		pool = &connPool{
+			parent:   p,
+			key:      key,
+			network:  network,
+			address:  address,
+			target:   p.cfg.MinIdle,
+			lastUsed: time.Now(),
+			wake:     make(chan struct{}, 1),
+			logger:   p.logger.With(zap.String("upstream", address)),
+		}
+		p.pools[key] = pool
+
+		p.wg.Add(1)
+		go pool.maintain()
+	}
+	return pool
+}
+
+// Close stops all pools and closes their idle connections.
+func (p *connPools) Close() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// idleConn is a connection waiting in a pool.
+type idleConn struct {
+	net.Conn
+	since time.Time
+}
+
+// connPool is the pool of idle connections to a single upstream.
+type connPool struct {
+	parent  *connPools
+	key     string
+	network string
+	address string
+	logger  *zap.Logger
+	wake    chan struct{}
+
+	mu       sync.Mutex
+	idle     []idleConn
+	target   int
+	lastUsed time.Time
+	evicted  bool
+}
+
+// take removes a connection from the pool, or returns nil if the pool
+// is empty. Either way the pool is woken up to replace it; if it was
+// empty, the pool is also allowed to grow by one connection. Connections
+// that timed out or were closed by the upstream are discarded.
+func (p *connPool) take() net.Conn {
+	p.mu.Lock()
+	if p.evicted {
+		p.mu.Unlock()
+		return nil
+	}
+	p.lastUsed = time.Now()
+	var conn net.Conn
+	for len(p.idle) > 0 && conn == nil {
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(ic.since) > time.Duration(p.parent.cfg.IdleTimeout) {
+			ic.Close()
+			continue
+		}
+		if err := checkConn(ic.Conn); err != nil {
+			if c := p.logger.Check(zapcore.DebugLevel, "connection pool discarded dead connection"); c != nil {
+				c.Write(zap.Error(err))
+			}
+			ic.Close()
+			continue
+		}
+		conn = ic.Conn
+	}
+	if conn == nil && p.target < p.parent.cfg.MaxIdle {
+		p.target++
+	}
+	idle, target := len(p.idle), p.target
+	p.mu.Unlock()
+
+	result := "hit"
+	if conn == nil {
+		result = "miss"
+	}
+	scgiMetrics.poolTakes.WithLabelValues(p.address, result).Inc()
+	scgiMetrics.poolIdleConns.WithLabelValues(p.address).Set(float64(idle))
+	if c := p.logger.Check(zapcore.DebugLevel, "connection pool "+result); c != nil {
+		c.Write(zap.Int("idle", idle), zap.Int("target", target))
+	}
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+
+	return conn
+}
+
+// maintain keeps the pool filled up to its target, expiring idle
+// connections as they time out, until the parent pools are closed
+// or the pool is evicted for going unused.
+func (p *connPool) maintain() {
+	defer p.parent.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(p.parent.cfg.IdleTimeout) / 2)
+	defer ticker.Stop()
+
+	for {
+		p.fill()
+
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+			if p.evictIfUnused() {
+				return
+			}
+			p.expire()
+		case <-p.parent.ctx.Done():
+			p.close()
+			return
+		}
+	}
+}
+
+// evictIfUnused removes the pool from its parent and closes it if
+// it hasn't been taken from for the parent's evictAfter duration.
+func (p *connPool) evictIfUnused() bool {
+	p.parent.mu.Lock()
+	p.mu.Lock()
+	unused := time.Since(p.lastUsed)
+	evict := unused > p.parent.evictAfter
+	if evict {
+		// take may still be called by a request that got the pool
+		// just before; it will find it empty and dial instead
+		p.evicted = true
+		if p.parent.pools[p.key] == p {
+			delete(p.parent.pools, p.key)
+		}
+	}
+	p.mu.Unlock()
+	p.parent.mu.Unlock()
+
+	if evict {
+		p.close()
+		if c := p.logger.Check(zapcore.DebugLevel, "connection pool evicted"); c != nil {
+			c.Write(zap.Duration("unused", unused))
+		}
+	}
+	return evict
+}
+
+// close closes the idle connections of the pool.
+func (p *connPool) close() {
+	p.mu.Lock()
+	for _, ic := range p.idle {
+		ic.Close()
+	}
+	p.idle = nil
+	p.mu.Unlock()
+	scgiMetrics.poolIdleConns.DeleteLabelValues(p.address)
+}
+
+// fill dials new connections until the pool reaches its target.
+func (p *connPool) fill() {
+	for {
+		p.mu.Lock()
+		missing := p.target - len(p.idle)
+		p.mu.Unlock()
+		if missing <= 0 {
+			return
+		}
+
+		conn, err := p.parent.dialer.DialContext(p.parent.ctx, p.network, p.address)
+		if err != nil {
+			// try again on the next tick
+			if p.parent.ctx.Err() == nil {
+				if c := p.logger.Check(zapcore.WarnLevel, "connection pool dial failed"); c != nil {
+					c.Write(zap.Error(err))
+				}
+			}
+			return
+		}
+
+		p.mu.Lock()
+		p.idle = append(p.idle, idleConn{Conn: conn, since: time.Now()})
+		idle := len(p.idle)
+		p.mu.Unlock()
+
+		scgiMetrics.poolIdleConns.WithLabelValues(p.address).Set(float64(idle))
+	}
+}
+
+// expire closes connections that have been idle for too long, shrinking
+// the pool target by one for each of them down to the configured minimum.
+func (p *connPool) expire() {
+	cutoff := time.Now().Add(-time.Duration(p.parent.cfg.IdleTimeout))
+
+	p.mu.Lock()
+	var expired int
+	kept := p.idle[:0]
+	for _, ic := range p.idle {
+		if ic.since.Before(cutoff) {
+			ic.Close()
+			expired++
+			continue
+		}
+		kept = append(kept, ic)
+	}
+	p.idle = kept
+	p.target = max(p.target-expired, p.parent.cfg.MinIdle)
+	idle, target := len(p.idle), p.target
+	p.mu.Unlock()
+
+	if expired == 0 {
+		return
+	}
+	scgiMetrics.poolIdleConns.WithLabelValues(p.address).Set(float64(idle))
+	if c := p.logger.Check(zapcore.DebugLevel, "connection pool expired idle connections"); c != nil {
+		c.Write(zap.Int("expired", expired), zap.Int("idle", idle), zap.Int("target", target))
+	}
+}
@@ -12,17 +12,14 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !unix
+
 package scgi
 
-import (
-	"bytes"
-)
+import "net"
 
-type streamReader struct {
-	c      *client
-	stderr bytes.Buffer
+// checkConn can't tell whether an idle connection is still alive
+// on this platform, so connections are only discarded as they time out.
+func checkConn(net.Conn) error {
+	return nil
 }
-
-func (r *streamReader) Read(p []byte) (int, error) {
-	return r.c.rwc.Read(p)
-}
\ No newline at end of file
@@ -0,0 +1,138 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// acceptConns accepts connections on a local TCP port until the end of
+// the test, handing the upstream's side of each to the returned channel.
+func acceptConns(t *testing.T) (net.Listener, <-chan net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	conns := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			conns <- conn
+		}
+	}()
+	return l, conns
+}
+
+// waitIdle waits until pool holds n idle connections.
+func waitIdle(t *testing.T, pool *connPool, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		pool.mu.Lock()
+		idle := len(pool.idle)
+		pool.mu.Unlock()
+		if idle == n {
+			return
+		}
+	}
+	t.Fatalf("pool never reached %d idle connections", n)
+}
+
+func TestConnPoolDiscardsDeadConns(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("dead connections are not detected on windows")
+	}
+	l, conns := acceptConns(t)
+	pools := newConnPools(ConnPool{MinIdle: 1}, time.Second, zaptest.NewLogger(t))
+	t.Cleanup(pools.Close)
+
+	pool := pools.pool("tcp", l.Addr().String())
+	waitIdle(t, pool, 1)
+
+	// a live connection is handed out
+	conn := pool.take()
+	if conn == nil {
+		t.Fatal("got no connection from a filled pool")
+	}
+	conn.Close()
+	<-conns
+
+	// one closed by the upstream while idle is not
+	waitIdle(t, pool, 1)
+	upstream := <-conns
+	upstream.Close()
+	time.Sleep(50 * time.Millisecond) // let the FIN arrive
+	if conn := pool.take(); conn != nil {
+		conn.Close()
+		t.Error("got a connection the upstream closed")
+	}
+}
+
+func TestConnPoolsEvictUnused(t *testing.T) {
+	l, conns := acceptConns(t)
+	pools := newConnPools(ConnPool{MinIdle: 1, IdleTimeout: caddy.Duration(20 * time.Millisecond)}, time.Second, zaptest.NewLogger(t))
+	pools.evictAfter = 100 * time.Millisecond
+	t.Cleanup(pools.Close)
+
+	key := "tcp/" + l.Addr().String()
+	pool := pools.pool("tcp", l.Addr().String())
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		pools.mu.Lock()
+		_, ok := pools.pools[key]
+		pools.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unused pool was not evicted")
+		}
+	}
+	if conn := pool.take(); conn != nil {
+		t.Error("got a connection from an evicted pool")
+	}
+
+	// the evicted pool closed its connections and dials no more
+	for {
+		select {
+		case upstream := <-conns:
+			upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := upstream.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("got %v reading a pooled connection, want EOF", err)
+			}
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+
+	// the next request starts a new pool
+	if pools.pool("tcp", l.Addr().String()) == pool {
+		t.Error("got the evicted pool back")
+	}
+}
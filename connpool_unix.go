@@ -0,0 +1,64 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package scgi
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// errUnexpectedRead is returned by checkConn for an idle connection
+// the upstream sent data on before receiving a request.
+var errUnexpectedRead = errors.New("unexpected read from idle connection")
+
+// checkConn reports whether conn was closed by the upstream while idle,
+// with a non-blocking read of its socket. Deadlines can't be used for this,
+// as a read with a deadline in the past fails without reading the socket.
+func checkConn(conn net.Conn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var checkErr error
+	err = rc.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		n, err := syscall.Read(int(fd), buf[:])
+		switch {
+		case n == 0 && err == nil:
+			checkErr = io.EOF
+		case n > 0:
+			checkErr = errUnexpectedRead
+		case err == syscall.EAGAIN || err == syscall.EWOULDBLOCK:
+			checkErr = nil
+		default:
+			checkErr = err
+		}
+		// never wait for the socket to become readable
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return checkErr
+}
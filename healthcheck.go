@@ -0,0 +1,169 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// maxHealthCheckBodyBytes is the maximum number of bytes
+// of a health check response matched against ExpectBody.
+const maxHealthCheckBodyBytes = 1 << 20
+
+// HealthCheck configures the SCGI request sent to each upstream by the
+// reverse proxy's active health checks, and how its response is judged.
+//
+// Active health checks are still enabled and scheduled by the reverse
+// proxy, e.g. with its `health_uri` and `health_interval` options; its
+// requests are sent through the transport like any other. Without a
+// HealthCheck, they are sent as they are and judged by the reverse proxy.
+type HealthCheck struct {
+	// The SCRIPT_NAME of the request. SCRIPT_FILENAME is derived from it
+	// and the transport's root, and PATH_INFO is cleared. Default: the
+	// path of the reverse proxy's health check URI.
+	ScriptName string `json:"script_name,omitempty"`
+
+	// The REQUEST_URI of the request, which also sets QUERY_STRING.
+	// Default: the reverse proxy's health check URI.
+	RequestURI string `json:"request_uri,omitempty"`
+
+	// The REQUEST_METHOD of the request. Default: the reverse proxy's
+	// health check method.
+	Method string `json:"method,omitempty"`
+
+	// Extra environment variables, added after the transport's own.
+	EnvVars map[string]string `json:"env,omitempty"`
+
+	// The status code the upstream must respond with. A single digit
+	// matches a class of status codes, e.g. `2` for 2xx.
+	ExpectStatus int `json:"expect_status,omitempty"`
+
+	// A regular expression the first 1 MiB of the response body
+	// must match.
+	ExpectBody string `json:"expect_body,omitempty"`
+
+	bodyRegexp *regexp.Regexp
+}
+
+// provision validates hc and compiles its body regexp.
+func (hc *HealthCheck) provision() error {
+	if hc.RequestURI != "" {
+		if _, err := url.ParseRequestURI(hc.RequestURI); err != nil {
+			return fmt.Errorf("invalid request_uri: %v", err)
+		}
+	}
+	if hc.ExpectStatus != 0 && (hc.ExpectStatus < 1 || hc.ExpectStatus > 5) &&
+		(hc.ExpectStatus < 100 || hc.ExpectStatus > 599) {
+		return fmt.Errorf("invalid expect_status: %d", hc.ExpectStatus)
+	}
+	hc.Method = strings.ToUpper(hc.Method)
+	if hc.ExpectBody != "" {
+		re, err := regexp.Compile(hc.ExpectBody)
+		if err != nil {
+			return fmt.Errorf("expect_body: %v", err)
+		}
+		hc.bodyRegexp = re
+	}
+	return nil
+}
+
+// healthCheckScheme is the scheme of the URLs of the reverse
+// proxy's active health check requests sent through the transport.
+const healthCheckScheme = "scgi"
+
+// OverrideHealthCheckScheme marks the reverse proxy's active health check
+// requests by their URL scheme, so that the transport can tell them apart
+// from proxied requests, whose URLs have none.
+func (Transport) OverrideHealthCheckScheme(base *url.URL, _ string) {
+	base.Scheme = healthCheckScheme
+}
+
+// isHealthCheck reports whether r is an active health check request
+// of the reverse proxy.
+func isHealthCheck(r *http.Request) bool {
+	return r.URL.Scheme == healthCheckScheme
+}
+
+// request returns r with the method configured by hc.
+func (hc *HealthCheck) request(r *http.Request) *http.Request {
+	if hc.Method == "" || hc.Method == r.Method {
+		return r
+	}
+	r = r.Clone(r.Context())
+	r.Method = hc.Method
+	return r
+}
+
+// apply overrides the variables of env as configured by hc.
+func (hc *HealthCheck) apply(env envVars, repl *caddy.Replacer) {
+	if hc.ScriptName != "" {
+		scriptName := hc.ScriptName
+		if !strings.HasPrefix(scriptName, "/") {
+			scriptName = "/" + scriptName
+		}
+		env["SCRIPT_NAME"] = scriptName
+		env["SCRIPT_FILENAME"] = caddyhttp.SanitizedPathJoin(env["DOCUMENT_ROOT"], scriptName)
+		env["DOCUMENT_URI"] = scriptName
+		env["PATH_INFO"] = ""
+		delete(env, "PATH_TRANSLATED")
+	}
+	if hc.RequestURI != "" {
+		env["REQUEST_URI"] = hc.RequestURI
+		_, env["QUERY_STRING"], _ = strings.Cut(hc.RequestURI, "?")
+	}
+	for key, value := range hc.EnvVars {
+		env[key] = repl.ReplaceAll(value, "")
+	}
+}
+
+// check judges resp against the expectations of hc. A response that
+// doesn't meet them is closed and an error is returned, which marks the
+// upstream as failing the health check. A response that does is passed
+// on with a 200 status if hc expects a status, so the reverse proxy's
+// own status check doesn't second-guess it.
+func (hc *HealthCheck) check(resp *http.Response) (*http.Response, error) {
+	if hc.ExpectStatus != 0 && !caddyhttp.StatusCodeMatches(resp.StatusCode, hc.ExpectStatus) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected health check status: %d", resp.StatusCode)
+	}
+
+	if hc.bodyRegexp != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBodyBytes))
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading health check response body: %v", err)
+		}
+		if !hc.bodyRegexp.Match(body) {
+			return nil, fmt.Errorf("health check response body does not match %q", hc.ExpectBody)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+	}
+
+	if hc.ExpectStatus != 0 {
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+	}
+	return resp, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Elegant996/scgi-transport/scgi"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// newHealthCheckRequest returns a request to upstream made the way the
+// reverse proxy's active health checks make them, with tr as transport.
+func newHealthCheckRequest(t *testing.T, tr *Transport, upstream net.Addr, path string) *http.Request {
+	t.Helper()
+	u := &url.URL{Scheme: "http", Host: upstream.String()}
+	tr.OverrideHealthCheckScheme(u, "")
+	u.Path = path
+
+	caddyCtx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	ctx := caddyCtx.Context
+	ctx = context.WithValue(ctx, caddy.ReplacerCtxKey, caddy.NewReplacer())
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{
+		"reverse_proxy.dial_info": reverseproxy.DialInfo{
+			Network: upstream.Network(),
+			Address: upstream.String(),
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, caddyhttp.OriginalRequestCtxKey, *req)
+	return req.WithContext(ctx)
+}
+
+func TestRoundTripHealthCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		healthCheck *HealthCheck
+		wantScript  string
+		wantStatus  int
+	}{
+		{name: "as is", wantScript: "/status", wantStatus: http.StatusNoContent},
+		{
+			name:        "configured",
+			healthCheck: &HealthCheck{ScriptName: "/health.php", ExpectStatus: 2},
+			wantScript:  "/health.php",
+			wantStatus:  http.StatusOK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotScript string
+			l := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotScript = scgi.ProcessEnv(r)["SCRIPT_NAME"]
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			tr := newTestTransport(t, &Transport{HealthCheck: tt.healthCheck})
+
+			// sent with an http.Client, as by the reverse proxy
+			client := &http.Client{Transport: tr}
+			resp, err := client.Do(newHealthCheckRequest(t, tr, l.Addr(), "/status"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if gotScript != tt.wantScript {
+				t.Errorf("got SCRIPT_NAME %q, want %q", gotScript, tt.wantScript)
+			}
+		})
+	}
+}
+
+func TestIsHealthCheck(t *testing.T) {
+	upstream := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7777}
+	if req := newProxyRequest(http.MethodGet, "/", nil, upstream); isHealthCheck(req) {
+		t.Error("proxied request taken for a health check")
+	}
+	if req := newHealthCheckRequest(t, &Transport{}, upstream, "/"); !isHealthCheck(req) {
+		t.Error("health check request not recognized")
+	}
+}
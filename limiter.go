@@ -0,0 +1,143 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("upstream connection queue is full")
+	errQueueTimeout = errors.New("timed out waiting for an upstream connection")
+)
+
+// connLimiters limits the number of simultaneous connections to each
+// upstream, keyed by network and address. Requests over the limit wait
+// in a bounded queue for a connection to be closed. The limiter of an
+// upstream is removed once it has no connections and no waiters, so
+// that dynamic upstreams don't accumulate.
+type connLimiters struct {
+	maxConns     int
+	maxQueue     int
+	queueTimeout time.Duration
+
+	mu       sync.Mutex
+	limiters map[string]*connLimiter
+}
+
+// connLimiter limits the connections to a single upstream.
+// Its waiting count is guarded by connLimiters.mu.
+type connLimiter struct {
+	slots   chan struct{}
+	waiting int
+}
+
+// acquire reserves a connection slot for address, waiting in the queue
+// if necessary. The returned function must be called to release the slot.
+func (l *connLimiters) acquire(ctx context.Context, network, address string) (func(), error) {
+	key := network + "/" + address
+
+	l.mu.Lock()
+	limiter, ok := l.limiters[key]
+	if !ok {
+		limiter = &connLimiter{slots: make(chan struct{}, l.maxConns)}
+		l.limiters[key] = limiter
+	}
+
+	release := func() {
+		l.mu.Lock()
+		<-limiter.slots
+		l.removeIfIdle(key, limiter)
+		l.mu.Unlock()
+	}
+
+	select {
+	case limiter.slots <- struct{}{}:
+		l.mu.Unlock()
+		return release, nil
+	default:
+	}
+
+	if limiter.waiting >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, errQueueFull
+	}
+	limiter.waiting++
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		limiter.waiting--
+		l.removeIfIdle(key, limiter)
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errQueueTimeout
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// removeIfIdle removes the limiter of key if it has no connections
+// and no waiters. l.mu must be held.
+func (l *connLimiters) removeIfIdle(key string, limiter *connLimiter) {
+	if len(limiter.slots) == 0 && limiter.waiting == 0 {
+		delete(l.limiters, key)
+	}
+}
+
+// retryAfter returns the value of the Retry-After header sent
+// when a request is turned away, in whole seconds.
+func (l *connLimiters) retryAfter() string {
+	return strconv.Itoa(max(1, int(math.Ceil(l.queueTimeout.Seconds()))))
+}
+
+// serviceUnavailable returns a 503 Service Unavailable response telling
+// the client to try again after retryAfter seconds.
+func serviceUnavailable(r *http.Request, retryAfter string) *http.Response {
+	resp := statusResponse(r, http.StatusServiceUnavailable)
+	resp.Header.Set("Retry-After", retryAfter)
+	return resp
+}
+
+// statusResponse returns an empty response to r with the given status.
+// It is returned instead of an error when a request is turned away
+// before reaching the upstream, so that the reverse proxy doesn't
+// count it as a failure of the upstream.
+func statusResponse(r *http.Request, code int) *http.Response {
+	return &http.Response{
+		Status:     strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    r,
+	}
+}
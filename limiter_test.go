@@ -0,0 +1,146 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestConnLimitersRemoveIdle(t *testing.T) {
+	l := &connLimiters{
+		maxConns:     1,
+		maxQueue:     1,
+		queueTimeout: time.Minute,
+		limiters:     make(map[string]*connLimiter),
+	}
+	size := func() int {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.limiters)
+	}
+
+	release, err := l.acquire(context.Background(), "tcp", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a waiter keeps the limiter after the slot is released
+	acquired := make(chan func())
+	go func() {
+		release, err := l.acquire(context.Background(), "tcp", "127.0.0.1:1")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	for {
+		l.mu.Lock()
+		waiting := l.limiters["tcp/127.0.0.1:1"].waiting
+		l.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	release = <-acquired
+	if n := size(); n != 1 {
+		t.Fatalf("got %d limiters while a slot is in use, want 1", n)
+	}
+
+	release()
+	if n := size(); n != 0 {
+		t.Errorf("got %d limiters after all slots were released, want 0", n)
+	}
+
+	// a waiter that gives up removes the limiter too
+	release, err = l.acquire(context.Background(), "tcp", "127.0.0.1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx, "tcp", "127.0.0.1:2"); err == nil {
+		t.Fatal("acquired a slot that is in use")
+	}
+	release()
+	if n := size(); n != 0 {
+		t.Errorf("got %d limiters after the waiter gave up, want 0", n)
+	}
+}
+
+func TestRoundTripAtCapacity(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		maxQueueSize   int
+		queueTimeout   time.Duration
+		wantRetryAfter string
+	}{
+		{name: "queue full", queueTimeout: 10 * time.Second, wantRetryAfter: "10"},
+		{name: "queue timeout", maxQueueSize: 1, queueTimeout: 20 * time.Millisecond, wantRetryAfter: "1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			unblock := make(chan struct{})
+			l := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					close(started)
+					<-unblock
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			tr := newTestTransport(t, &Transport{
+				MaxConnsPerUpstream: 1,
+				MaxQueueSize:        tt.maxQueueSize,
+				QueueTimeout:        caddy.Duration(tt.queueTimeout),
+			})
+
+			// hold the only connection slot
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				resp, err := tr.RoundTrip(newProxyRequest(http.MethodGet, "/slow", nil, l.Addr()))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			}()
+			<-started
+
+			resp, err := tr.RoundTrip(newProxyRequest(http.MethodGet, "/", nil, l.Addr()))
+			close(unblock)
+			<-done
+			if err != nil {
+				t.Fatalf("got error %v, want a 503 response", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+			}
+			if got := resp.Header.Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("got Retry-After %q, want %q", got, tt.wantRetryAfter)
+			}
+			if n := l.accepted.Load(); n != 1 {
+				t.Errorf("upstream accepted %d connections, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace, metricsSubsystem = "caddy", "reverse_proxy_scgi"
+
+var scgiMetrics = struct {
+	poolIdleConns *prometheus.GaugeVec
+	poolTakes     *prometheus.CounterVec
+
+	dialDuration    *prometheus.HistogramVec
+	writeDuration   *prometheus.HistogramVec
+	ttfb            *prometheus.HistogramVec
+	requestDuration *prometheus.HistogramVec
+	sentBytes       *prometheus.CounterVec
+	receivedBytes   *prometheus.CounterVec
+	dialFailures    *prometheus.CounterVec
+	timeouts        *prometheus.CounterVec
+	parseErrors     *prometheus.CounterVec
+}{
+	poolIdleConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "pool_idle_conns",
+		Help:      "Number of idle connections in the SCGI connection pool.",
+	}, []string{"upstream"}),
+	poolTakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "pool_takes_total",
+		Help:      "Counter of connections requested from the SCGI connection pool, by whether one was idle (hit) or not (miss).",
+	}, []string{"upstream", "result"}),
+
+	dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "dial_duration_seconds",
+		Help:      "Histogram of the time taken to connect to the SCGI server, including taking a pooled connection.",
+	}, []string{"upstream"}),
+	writeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "write_duration_seconds",
+		Help:      "Histogram of the time taken to send the netstring header and request body to the SCGI server.",
+	}, []string{"upstream"}),
+	ttfb: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "time_to_first_byte_seconds",
+		Help:      "Histogram of the time from starting to send a request to the SCGI server until the first byte of its response.",
+	}, []string{"upstream"}),
+	requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "request_duration_seconds",
+		Help:      "Histogram of the total duration of exchanges with the SCGI server, until the response body is closed.",
+	}, []string{"upstream", "code_class"}),
+	sentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "sent_bytes_total",
+		Help:      "Counter of bytes sent to the SCGI server, including netstring headers.",
+	}, []string{"upstream"}),
+	receivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "received_bytes_total",
+		Help:      "Counter of bytes received from the SCGI server, including response headers.",
+	}, []string{"upstream", "code_class"}),
+	dialFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "dial_failures_total",
+		Help:      "Counter of failed attempts to connect to the SCGI server.",
+	}, []string{"upstream"}),
+	timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "timeouts_total",
+		Help:      "Counter of exchanges with the SCGI server that hit the read or write timeout.",
+	}, []string{"upstream"}),
+	parseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "parse_errors_total",
+		Help:      "Counter of responses from the SCGI server with a malformed, invalid or oversized header.",
+	}, []string{"upstream"}),
+}
+
+// registerMetrics registers the SCGI transport's metrics with registry.
+// Multiple transports share the same collectors, so collectors that are
+// already registered are ignored.
+func registerMetrics(registry *prometheus.Registry) error {
+	if registry == nil {
+		return nil
+	}
+
+	collectors := []prometheus.Collector{
+		scgiMetrics.poolIdleConns,
+		scgiMetrics.poolTakes,
+		scgiMetrics.dialDuration,
+		scgiMetrics.writeDuration,
+		scgiMetrics.ttfb,
+		scgiMetrics.requestDuration,
+		scgiMetrics.sentBytes,
+		scgiMetrics.receivedBytes,
+		scgiMetrics.dialFailures,
+		scgiMetrics.timeouts,
+		scgiMetrics.parseErrors,
+	}
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			if are := (prometheus.AlreadyRegisteredError{}); !errors.As(err, &are) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exchangeStats describes an exchange with the SCGI server.
+// The byte counts and timeout flag may be updated concurrently
+// when the connection is a tunnel.
+type exchangeStats struct {
+	start         time.Time // when the request started, including any queueing
+	dialDuration  time.Duration
+	writeStart    time.Time
+	writeDuration time.Duration
+	ttfb          time.Duration // since writeStart
+	status        int           // 0 if there was no valid response
+	statusLine    string        // the status line or Status field as received
+	parseError    bool
+
+	sent     atomic.Int64
+	received atomic.Int64
+	timedOut atomic.Bool
+}
+
+// observeExchange records the metrics of a finished exchange with upstream.
+func observeExchange(upstream string, s *exchangeStats) {
+	codeClass := "error"
+	if s.status > 0 {
+		codeClass = strconv.Itoa(s.status/100) + "xx"
+	}
+
+	scgiMetrics.dialDuration.WithLabelValues(upstream).Observe(s.dialDuration.Seconds())
+	if s.writeDuration > 0 {
+		scgiMetrics.writeDuration.WithLabelValues(upstream).Observe(s.writeDuration.Seconds())
+	}
+	if s.ttfb > 0 {
+		scgiMetrics.ttfb.WithLabelValues(upstream).Observe(s.ttfb.Seconds())
+	}
+	scgiMetrics.requestDuration.WithLabelValues(upstream, codeClass).Observe(time.Since(s.start).Seconds())
+	scgiMetrics.sentBytes.WithLabelValues(upstream).Add(float64(s.sent.Load()))
+	scgiMetrics.receivedBytes.WithLabelValues(upstream, codeClass).Add(float64(s.received.Load()))
+	if s.timedOut.Load() {
+		scgiMetrics.timeouts.WithLabelValues(upstream).Inc()
+	}
+	if s.parseError {
+		scgiMetrics.parseErrors.WithLabelValues(upstream).Inc()
+	}
+}
+
+// exchangeConn is a connection to the SCGI server that records the bytes
+// sent and received and any timeouts in the stats of its exchange.
+type exchangeConn struct {
+	net.Conn
+	ctx   context.Context // the request's context
+	stats *exchangeStats
+
+	// onClose, if set, is called once when the connection is closed
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *exchangeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stats.received.Add(int64(n))
+	c.noteTimeout(err)
+	return n, err
+}
+
+func (c *exchangeConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.sent.Add(int64(n))
+	c.noteTimeout(err)
+	return n, err
+}
+
+func (c *exchangeConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return err
+}
+
+// noteTimeout notes err in the stats if it is a timeout, unless
+// the exchange was aborted because the request's context is done.
+func (c *exchangeConn) noteTimeout(err error) {
+	var netErr net.Error
+	if err != nil && c.ctx.Err() == nil && errors.As(err, &netErr) && netErr.Timeout() {
+		c.stats.timedOut.Store(true)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// serveResponse calls serve for r in a new goroutine and returns what it
+// writes as an *http.Response as soon as the header has been written; the
+// body streams whatever serve writes afterwards. If serve fails before
+// writing anything, its error is returned instead.
+func serveResponse(r *http.Request, serve func(w http.ResponseWriter) error) (*http.Response, error) {
+	return serveResponseWithHeader(r, make(http.Header), serve)
+}
+
+// serveResponseWithHeader is like serveResponse, but the response header
+// starts out as header rather than empty.
+func serveResponseWithHeader(r *http.Request, header http.Header, serve func(w http.ResponseWriter) error) (*http.Response, error) {
+	ctx := r.Context()
+
+	pr, pw := io.Pipe()
+	w := &pipeResponseWriter{
+		header: header,
+		body:   pr,
+		pw:     pw,
+		resp:   make(chan *http.Response, 1),
+		req:    r,
+	}
+	errc := make(chan error, 1)
+
+	go func() {
+		err := serve(w)
+		if err != nil && !w.wroteHeader {
+			errc <- err
+			pw.CloseWithError(err)
+			return
+		}
+		w.WriteHeader(http.StatusOK) // make sure we respond even if nothing was written
+		pw.CloseWithError(err)
+	}()
+
+	select {
+	case resp := <-w.resp:
+		return resp, nil
+	case err := <-errc:
+		return nil, err
+	case <-ctx.Done():
+		pr.Close()
+		return nil, fmt.Errorf("%w: %w", ErrAborted, context.Cause(ctx))
+	}
+}
+
+// pipeResponseWriter is an http.ResponseWriter that turns what
+// is written to it into an *http.Response with a streamed body.
+type pipeResponseWriter struct {
+	header      http.Header
+	wroteHeader bool
+	body        *io.PipeReader
+	pw          *io.PipeWriter
+	resp        chan *http.Response
+	req         *http.Request
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(p)
+}
+
+func (w *pipeResponseWriter) WriteHeader(code int) {
+	// informational responses are not relayed
+	if w.wroteHeader || code < http.StatusOK {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.header.Clone()
+	// the outer server sets these headers itself
+	header.Del("Server")
+	header.Del("Alt-Svc")
+
+	contentLength := int64(-1)
+	if cl, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		contentLength = cl
+	}
+
+	w.resp <- &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          w.body,
+		ContentLength: contentLength,
+		Request:       w.req,
+	}
+}
+
+func (w *pipeResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*pipeResponseWriter)(nil)
+	_ http.Flusher        = (*pipeResponseWriter)(nil)
+)
@@ -0,0 +1,140 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// localRedirectsCtxKey is the context key for the number of
+// local redirects followed so far while serving a request.
+type localRedirectsCtxKey struct{}
+
+// isLocalRedirect reports whether resp is a local redirect response as
+// defined by RFC 3875 section 6.2.2: a Location header holding an absolute
+// path and nothing else, in particular no Status. Only CGI responses can be
+// local redirects; impliedStatus reports whether resp is a CGI response
+// without a Status field.
+func isLocalRedirect(resp *http.Response, impliedStatus bool) bool {
+	if !impliedStatus || len(resp.Header) != 1 {
+		return false
+	}
+	location := resp.Header.Get("Location")
+	return strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//")
+}
+
+// localRedirect serves a local redirect to location by dispatching a GET
+// request for it through the server's handler chain again, as if the client
+// had requested it. It is made from the request as received by the server,
+// not as proxied to the upstream. The response of that request is returned.
+// Local redirects are followed at most t.MaxLocalRedirects times per request.
+//
+// A local redirect that can't be followed is answered with a response of
+// the appropriate status rather than an error, as the upstream responded
+// as it should and mustn't be counted as failing.
+func (t Transport) localRedirect(r *http.Request, location string) (*http.Response, error) {
+	ctx := r.Context()
+
+	count, _ := ctx.Value(localRedirectsCtxKey{}).(int)
+	if count >= t.MaxLocalRedirects {
+		return t.redirectFailed(r, location, http.StatusLoopDetected, errors.New("too many local redirects")), nil
+	}
+
+	server, ok := ctx.Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	if !ok {
+		return t.redirectFailed(r, location, http.StatusBadGateway, errors.New("local redirect outside of an HTTP server")), nil
+	}
+
+	u, err := url.ParseRequestURI(location)
+	if err != nil {
+		return t.redirectFailed(r, location, http.StatusBadGateway, fmt.Errorf("parsing local redirect location: %v", err)), nil
+	}
+
+	if c := t.logger.Check(zapcore.DebugLevel, "following local redirect"); c != nil {
+		c.Write(zap.String("location", location), zap.Int("redirects", count+1))
+	}
+
+	req := receivedRequest(r)
+	req = req.WithContext(context.WithValue(ctx, localRedirectsCtxKey{}, count+1))
+	req.Method = http.MethodGet
+	req.URL = u
+	req.RequestURI = u.RequestURI()
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	req.TransferEncoding = nil
+	req.Header.Del("Content-Length")
+	req.Header.Del("Content-Type")
+
+	return serveResponse(req, func(w http.ResponseWriter) error {
+		server.ServeHTTP(w, req)
+		return nil
+	})
+}
+
+// redirectFailed logs err, the reason the local redirect to location
+// can't be followed, and returns a response to r with the given status.
+func (t Transport) redirectFailed(r *http.Request, location string, status int, err error) *http.Response {
+	if c := t.logger.Check(zapcore.ErrorLevel, "cannot follow local redirect"); c != nil {
+		c.Write(zap.String("location", location), zap.Int("status", status), zap.Error(err))
+	}
+	return statusResponse(r, status)
+}
+
+// receivedRequest returns a copy of the proxied request r with the host and
+// header fields of the request as received by the server, undoing what the
+// reverse proxy changed for the upstream, such as header_up, X-Forwarded-*
+// and Host rewrites. The proxy works on a copy of the request, while the
+// server's replacer still reads the received one, so the values are taken
+// from there. Fields the proxy removed altogether can't be restored; those
+// are mostly hop-by-hop fields, which don't apply to internal requests.
+func receivedRequest(r *http.Request) *http.Request {
+	ctx := r.Context()
+	req := r.Clone(ctx)
+
+	if orig, ok := ctx.Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok {
+		req.RemoteAddr = orig.RemoteAddr
+	}
+
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return req
+	}
+	if host, ok := repl.GetString("http.request.hostport"); ok {
+		req.Host = host
+	}
+	for field, vals := range req.Header {
+		// the replacer joins repeated fields with commas; fields
+		// the proxy added are empty, as the client didn't send them
+		val, _ := repl.GetString("http.request.header." + field)
+		switch {
+		case val == "":
+			req.Header.Del(field)
+		case val != strings.Join(vals, ","):
+			req.Header[field] = []string{val}
+		}
+	}
+	return req
+}
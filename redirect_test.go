@@ -0,0 +1,207 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestReceivedRequest(t *testing.T) {
+	received := httptest.NewRequest(http.MethodPost, "http://example.com/form", nil)
+	received.Header["Accept"] = []string{"text/html", "application/xhtml+xml"}
+	received.Header.Set("Cookie", "session=abc")
+	received.Header.Set("X-Forwarded-For", "203.0.113.9")
+	caddyhttp.NewTestReplacer(received)
+
+	// the reverse proxy prepares a copy of the request for the upstream
+	proxied := received.Clone(received.Context())
+	proxied.Host = "app.internal"
+	proxied.Header.Set("X-Forwarded-For", "203.0.113.9, 192.0.2.1")
+	proxied.Header.Set("X-Forwarded-Host", "example.com")
+	proxied.Header.Set("X-Upstream", "added by header_up")
+	proxied.Header.Set("User-Agent", "")
+
+	req := receivedRequest(proxied)
+
+	if req.Host != "example.com" {
+		t.Errorf("got host %q, want %q", req.Host, "example.com")
+	}
+	for field, want := range map[string][]string{
+		"Accept":           {"text/html", "application/xhtml+xml"},
+		"Cookie":           {"session=abc"},
+		"X-Forwarded-For":  {"203.0.113.9"},
+		"X-Forwarded-Host": nil,
+		"X-Upstream":       nil,
+		"User-Agent":       nil,
+	} {
+		if got := req.Header[field]; !slices.Equal(got, want) {
+			t.Errorf("got %s %q, want %q", field, got, want)
+		}
+	}
+	if proxied.Host != "app.internal" || proxied.Header.Get("X-Upstream") == "" {
+		t.Error("the proxied request was modified")
+	}
+}
+
+func TestRoundTripLocalRedirect(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		response string
+		local    bool
+	}{
+		{name: "cgi", response: "Location: /elsewhere\r\n\r\n", local: true},
+		{name: "cgi with status", response: "Status: 302 Found\r\nLocation: /elsewhere\r\n\r\n"},
+		{name: "nph redirect", response: "HTTP/1.1 302 Found\r\nLocation: /elsewhere\r\n\r\n"},
+		{name: "nph created", response: "HTTP/1.1 201 Created\r\nLocation: /elsewhere\r\n\r\n"},
+		{name: "cgi client redirect", response: "Location: https://example.com/\r\n\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newRawServer(t, tt.response)
+			tr := newTestTransport(t, &Transport{MaxLocalRedirects: 1})
+
+			// with the limit already reached, following a local
+			// redirect stops with 508 before dispatching it
+			req := newProxyRequest(http.MethodGet, "/", nil, upstream)
+			req = req.WithContext(context.WithValue(req.Context(), localRedirectsCtxKey{}, 1))
+
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("got error %v, want a response", err)
+			}
+			resp.Body.Close()
+			followed := resp.StatusCode == http.StatusLoopDetected
+			if followed != tt.local {
+				t.Fatalf("followed local redirect: %t, want %t (status: %d)", followed, tt.local, resp.StatusCode)
+			}
+			if tt.local {
+				return
+			}
+			if resp.Header.Get("Location") == "" {
+				t.Error("response was passed on without its Location")
+			}
+		})
+	}
+}
+
+func TestRoundTripLocalRedirectFailures(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		location string
+		setup    func(*http.Request) *http.Request
+		want     int
+	}{
+		{
+			name:     "too many redirects",
+			location: "/elsewhere",
+			setup: func(req *http.Request) *http.Request {
+				return req.WithContext(context.WithValue(req.Context(), localRedirectsCtxKey{}, 1))
+			},
+			want: http.StatusLoopDetected,
+		},
+		{
+			name:     "outside of a server",
+			location: "/elsewhere",
+			setup: func(req *http.Request) *http.Request {
+				return req.WithContext(context.WithValue(req.Context(), caddyhttp.ServerCtxKey, nil))
+			},
+			want: http.StatusBadGateway,
+		},
+		{
+			name:     "bad location",
+			location: "/%zz",
+			setup:    func(req *http.Request) *http.Request { return req },
+			want:     http.StatusBadGateway,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newRawServer(t, "Location: "+tt.location+"\r\n\r\n")
+			tr := newTestTransport(t, &Transport{MaxLocalRedirects: 1})
+
+			resp, err := tr.RoundTrip(tt.setup(newProxyRequest(http.MethodGet, "/", nil, upstream)))
+			if err != nil {
+				t.Fatalf("got error %v, want a %d response", err, tt.want)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalRedirectReachesSecondRoute(t *testing.T) {
+	// keep Caddy from writing to the user's directories
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	upstream := newRawServer(t, "Location: /target?from=app\r\n\r\n")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cfg := fmt.Sprintf(`{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"logging": {"logs": {"default": {"level": "ERROR"}}},
+		"apps": {"http": {"servers": {"test": {
+			"listen": [%q],
+			"automatic_https": {"disable": true},
+			"routes": [
+				{
+					"match": [{"path": ["/target"]}],
+					"handle": [{"handler": "static_response", "body": "second route: {http.request.uri.query}"}]
+				},
+				{
+					"handle": [{
+						"handler": "reverse_proxy",
+						"transport": {"protocol": "scgi", "max_local_redirects": 1},
+						"upstreams": [{"dial": %q}]
+					}]
+				}
+			]
+		}}}}
+	}`, addr, upstream.String())
+	if err := caddy.Load([]byte(cfg), true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+
+	resp, err := http.Get("http://" + addr + "/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "second route: from=app" {
+		t.Errorf("got %d %q, want 200 from the second route", resp.StatusCode, body)
+	}
+}
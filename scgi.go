@@ -15,32 +15,50 @@
 package scgi
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
 
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/text/language"
 	"golang.org/x/text/search"
 
+	"github.com/Elegant996/scgi-transport/scgi"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 	"github.com/caddyserver/caddy/v2/modules/caddytls"
 )
 
+// placeholderPrefix is the prefix of the placeholders
+// the transport sets for each request.
+const placeholderPrefix = "http.reverse_proxy.scgi."
+
+// defaultStderrHeader is the default response header
+// field carrying the upstream's stderr messages.
+const defaultStderrHeader = "X-SCGI-Stderr"
+
 var (
 	ErrInvalidSplitPath = errors.New("split path contains non-ASCII characters")
 
-	noopLogger = zap.NewNop()
+	// ErrAborted is returned when an exchange with the SCGI server is cut
+	// short because the client request's context was cancelled. It always
+	// wraps the context's cause, e.g. context.Canceled.
+	ErrAborted = scgi.ErrAborted
 )
 
 func init() {
@@ -48,6 +66,21 @@ func init() {
 }
 
 // Transport facilitates SCGI communication.
+//
+// In addition to the placeholders of the reverse proxy, the following
+// placeholders are available for each request:
+//
+// Placeholder | Description
+// ------------|-------------
+// `{http.reverse_proxy.scgi.script_filename}` | The SCRIPT_FILENAME sent to the upstream
+// `{http.reverse_proxy.scgi.path_info}` | The PATH_INFO sent to the upstream
+// `{http.reverse_proxy.scgi.dial_duration}` | How long it took to connect to the upstream
+// `{http.reverse_proxy.scgi.write_duration}` | How long it took to send the request to the upstream
+// `{http.reverse_proxy.scgi.ttfb}` | How long it took from starting to send the request until the first byte of the response
+// `{http.reverse_proxy.scgi.upstream_status_line}` | The upstream's status line, or its `Status` header field
+//
+// The timings and status line are only available once the upstream
+// has responded.
 type Transport struct {
 	// Use this directory as the scgi root directory. Defaults to the root
 	// directory of the parent virtual host.
@@ -85,9 +118,104 @@ type Transport struct {
 	// Capture and log any messages sent by the upstream on stderr. Logs at WARN
 	// level by default. If the response has a 4xx or 5xx status ERROR level will
 	// be used instead.
+	//
+	// As SCGI has no stderr stream, the upstream sends these messages in the
+	// response header field named by StderrHeader, which is removed from the
+	// response.
 	CaptureStderr bool `json:"capture_stderr,omitempty"`
 
+	// The response header field carrying the upstream's stderr messages when
+	// CaptureStderr is enabled. Multiple fields are logged as separate lines.
+	// Default: `X-SCGI-Stderr`.
+	StderrHeader string `json:"stderr_header,omitempty"`
+
+	// The maximum size of a request body of unknown length (e.g. chunked or
+	// HTTP/2 requests without a Content-Length) that will be spooled in order
+	// to send an accurate CONTENT_LENGTH. The first 1 MiB is held in memory
+	// and the remainder is written to a temporary file. Larger bodies are
+	// rejected with 413. If unset, such requests are rejected with 411.
+	MaxSpoolSize int64 `json:"max_spool_size,omitempty"`
+
+	// Request headers that are never passed to the SCGI server as HTTP_*
+	// variables. Either the header field name (`X-Debug`) or the resulting
+	// variable name (`HTTP_X_DEBUG`) may be given. The `Proxy` header is
+	// always denied to mitigate httpoxy (https://httpoxy.org).
+	DenyHeaders []string `json:"deny_headers,omitempty"`
+
+	// How to handle request headers with underscores in their names. Since
+	// both `-` and `_` become `_` in HTTP_* variables, such headers can be
+	// used to spoof headers set by a trusted proxy (e.g. `X_Forwarded_For`
+	// for `X-Forwarded-For`). One of:
+	//
+	// - `drop` (default): silently drop the header
+	// - `reject`: strict mode, reject the request with 400 Bad Request
+	// - `allow`: lenient mode, pass the header on unless it collides with
+	//   another header; a header using hyphens always takes precedence,
+	//   and colliding headers with underscores are all dropped
+	UnderscoreHeaders string `json:"underscore_headers,omitempty"`
+
+	// Keep a pool of pre-established idle connections to each upstream.
+	// Cannot be combined with MaxConnsPerUpstream, as idle connections
+	// would not count against the limit.
+	ConnPool *ConnPool `json:"conn_pool,omitempty"`
+
+	// The maximum number of simultaneous connections to each upstream.
+	// Requests over the limit wait in a queue for a connection to close.
+	// Default: no limit.
+	MaxConnsPerUpstream int `json:"max_conns_per_upstream,omitempty"`
+
+	// The maximum number of requests waiting in the queue for each upstream.
+	// Requests arriving while the queue is full are answered with 503 and a
+	// Retry-After header. Default: `0` (no queue).
+	MaxQueueSize int `json:"max_queue_size,omitempty"`
+
+	// How long a request may wait in the queue before it is answered with
+	// 503 and a Retry-After header. Default: `10s`.
+	QueueTimeout caddy.Duration `json:"queue_timeout,omitempty"`
+
+	// The maximum number of CGI local redirects (RFC 3875 section 6.2.2)
+	// followed per request. A local redirect is a response consisting of only
+	// a Location header with an absolute path; it is served by running the
+	// request for that path through the server's handlers again instead of
+	// redirecting the client. Exceeding the limit results in 508 Loop
+	// Detected. Default: `0` (local redirects are passed to the client).
+	MaxLocalRedirects int `json:"max_local_redirects,omitempty"`
+
+	// Serve files named by an `X-Sendfile` or `X-Accel-Redirect` response
+	// header from this directory with Caddy's file server, instead of the
+	// upstream's response body, which is discarded. `X-Sendfile` holds a
+	// file path, which must be within this directory if it is absolute;
+	// `X-Accel-Redirect` holds a URI path relative to it. Range and
+	// conditional requests are supported, and the upstream's other response
+	// headers are kept. Default: sendfile headers are passed to the client.
+	SendfileRoot string `json:"sendfile_root,omitempty"`
+
+	// How responses from the SCGI server are parsed. One of:
+	//
+	// - `cgi`: a CGI response (RFC 3875 section 6), i.e. header fields
+	//   with the status given by the `Status` field, defaulting to 200
+	// - `nph`: a non-parsed header response, i.e. a complete HTTP/1.x
+	//   response starting with a status line such as `HTTP/1.1 200 OK`
+	// - `auto` (default): `nph` if the response starts with `HTTP/`,
+	//   `cgi` otherwise
+	ResponseMode string `json:"response_mode,omitempty"`
+
+	// The maximum size of the response header from the SCGI server,
+	// including any informational responses. Responses with larger or
+	// otherwise invalid headers (e.g. a malformed `Status` or invalid
+	// header field names or values) are logged and answered with 502.
+	// Default: 1 MiB.
+	MaxResponseHeaderBytes int64 `json:"max_response_header_bytes,omitempty"`
+
+	// Send the reverse proxy's active health checks as the SCGI request
+	// configured here, and judge upstreams by its response.
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+
 	serverSoftware string
+	fileServer     *fileserver.FileServer
+	pools          *connPools
+	limiters       *connLimiters
+	deniedVars     map[string]struct{}
 	logger         *zap.Logger
 }
 
@@ -107,15 +235,74 @@ func (t *Transport) Provision(ctx caddy.Context) error {
 		t.Root = "{http.vars.root}"
 	}
 
-	version, _ := caddy.Version()
-	t.serverSoftware = "Caddy/" + version
-
 	// Set a relatively short default dial timeout.
 	// This is helpful to make load-balancer retries more speedy.
 	if t.DialTimeout == 0 {
 		t.DialTimeout = caddy.Duration(3 * time.Second)
 	}
 
+	if err := t.provisionEnv(); err != nil {
+		return err
+	}
+
+	if t.StderrHeader == "" {
+		t.StderrHeader = defaultStderrHeader
+	}
+
+	switch t.ResponseMode {
+	case "":
+		t.ResponseMode = scgi.ResponseModeAuto
+	case scgi.ResponseModeCGI, scgi.ResponseModeNPH, scgi.ResponseModeAuto:
+	default:
+		return fmt.Errorf("unrecognized response_mode: %s", t.ResponseMode)
+	}
+
+	if t.HealthCheck != nil {
+		if err := t.HealthCheck.provision(); err != nil {
+			return fmt.Errorf("health_check: %v", err)
+		}
+	}
+
+	if err := registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("registering metrics: %v", err)
+	}
+
+	if t.ConnPool != nil && t.MaxConnsPerUpstream > 0 {
+		return fmt.Errorf("conn_pool cannot be combined with max_conns_per_upstream")
+	}
+
+	if t.ConnPool != nil {
+		t.pools = newConnPools(*t.ConnPool, time.Duration(t.DialTimeout), t.logger.Named("pool"))
+	}
+
+	if t.MaxConnsPerUpstream > 0 {
+		if t.QueueTimeout == 0 {
+			t.QueueTimeout = caddy.Duration(10 * time.Second)
+		}
+		t.limiters = &connLimiters{
+			maxConns:     t.MaxConnsPerUpstream,
+			maxQueue:     t.MaxQueueSize,
+			queueTimeout: time.Duration(t.QueueTimeout),
+			limiters:     make(map[string]*connLimiter),
+		}
+	}
+
+	if t.SendfileRoot != "" {
+		fsrv, err := newSendfileServer(ctx, t.SendfileRoot)
+		if err != nil {
+			return fmt.Errorf("setting up sendfile: %v", err)
+		}
+		t.fileServer = fsrv
+	}
+
+	return nil
+}
+
+// provisionEnv sets up the parts of t used to build the environment.
+func (t *Transport) provisionEnv() error {
+	version, _ := caddy.Version()
+	t.serverSoftware = "Caddy/" + version
+
 	var b strings.Builder
 
 	for i, split := range t.SplitPath {
@@ -139,19 +326,63 @@ func (t *Transport) Provision(ctx caddy.Context) error {
 		b.Reset()
 	}
 
+	switch t.UnderscoreHeaders {
+	case "":
+		t.UnderscoreHeaders = underscoreHeadersDrop
+	case underscoreHeadersDrop, underscoreHeadersReject, underscoreHeadersAllow:
+	default:
+		return fmt.Errorf("unrecognized underscore_headers mode: %s", t.UnderscoreHeaders)
+	}
+
+	t.deniedVars = maps.Clone(defaultDeniedVars)
+	for _, name := range t.DenyHeaders {
+		name = headerNameReplacer.Replace(strings.ToUpper(name))
+		if !strings.HasPrefix(name, "HTTP_") {
+			name = "HTTP_" + name
+		}
+		t.deniedVars[name] = struct{}{}
+	}
+
+	return nil
+}
+
+// Cleanup closes any idle pooled connections.
+func (t *Transport) Cleanup() error {
+	if t.pools != nil {
+		t.pools.Close()
+	}
 	return nil
 }
 
 // RoundTrip implements http.RoundTripper.
 func (t Transport) RoundTrip(r *http.Request) (*http.Response, error) {
-	server := r.Context().Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	start := time.Now()
+	healthCheck := isHealthCheck(r)
+	if healthCheck && t.HealthCheck != nil {
+		r = t.HealthCheck.request(r)
+	}
 
 	env, err := t.buildEnv(r)
 	if err != nil {
-		return nil, fmt.Errorf("building environment: %v", err)
+		if resp, ok := t.rejectRequest(r, err); ok {
+			return resp, nil
+		}
+		return nil, fmt.Errorf("building environment: %w", err)
 	}
 
 	ctx := r.Context()
+	repl := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if healthCheck && t.HealthCheck != nil {
+		t.HealthCheck.apply(env, repl)
+	}
+	repl.Set(placeholderPrefix+"script_filename", env["SCRIPT_FILENAME"])
+	repl.Set(placeholderPrefix+"path_info", env["PATH_INFO"])
+
+	// turn away environments that can't be encoded before taking up the upstream
+	if err := scgi.CheckEnv(env); err != nil {
+		resp, _ := t.rejectRequest(r, err)
+		return resp, nil
+	}
 
 	// extract dial information from request (should have been embedded by the reverse proxy)
 	network, address := "tcp", r.URL.Host
@@ -160,7 +391,10 @@ func (t Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 		address = dialInfo.Address
 	}
 
-	logCreds := server.Logs != nil && server.Logs.ShouldLogCredentials
+	// health checks may be sent outside of any server, in which
+	// case credentials are not logged
+	server, _ := ctx.Value(caddyhttp.ServerCtxKey).(*caddyhttp.Server)
+	logCreds := server != nil && server.Logs != nil && server.Logs.ShouldLogCredentials
 	loggableReq := caddyhttp.LoggableHTTPRequest{
 		Request:              r,
 		ShouldLogCredentials: logCreds,
@@ -179,57 +413,193 @@ func (t Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 		)
 	}
 
-	// connect to the backend
-	dialer := net.Dialer{Timeout: time.Duration(t.DialTimeout)}
-	conn, err := dialer.DialContext(ctx, network, address)
-	if err != nil {
-		return nil, fmt.Errorf("dialing backend: %v", err)
+	contentLength := r.ContentLength
+	if contentLength == 0 {
+		contentLength, _ = strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64)
 	}
-	defer func() {
-		// conn will be closed with the response body unless there's an error
+
+	// spool bodies of unknown length so CONTENT_LENGTH can be determined;
+	// this happens before dialing so slow uploads don't tie up the backend
+	var spool *spooledBody
+	if contentLength < 0 && t.MaxSpoolSize > 0 && r.Body != nil && r.Body != http.NoBody {
+		spool, err = spoolBody(r.Body, t.MaxSpoolSize)
+		if errors.Is(err, errBodyTooLarge) {
+			return statusResponse(r, http.StatusRequestEntityTooLarge), nil
+		}
 		if err != nil {
-			conn.Close()
+			return nil, err
 		}
-	}()
+		defer spool.Close()
 
-	// create the client that will facilitate the protocol
-	client := client{
-		rwc:    conn,
-		logger: logger,
-		stderr: t.CaptureStderr,
+		contentLength = spool.size
+	}
+	if contentLength < 0 {
+		if r.Body != nil && r.Body != http.NoBody {
+			return statusResponse(r, http.StatusLengthRequired), nil
+		}
+		contentLength = 0
 	}
 
-	// read/write timeouts
-	if err := client.SetReadTimeout(time.Duration(t.ReadTimeout)); err != nil {
-		return nil, fmt.Errorf("setting read timeout: %v", err)
+	// wait for the upstream to have a free connection slot, if limited
+	var release func()
+	if t.limiters != nil {
+		release, err = t.limiters.acquire(ctx, network, address)
+		if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+			if c := logger.Check(zapcore.WarnLevel, "upstream at capacity"); c != nil {
+				c.Write(zap.String("dial", address), zap.Error(err))
+			}
+			return serviceUnavailable(r, t.limiters.retryAfter()), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrAborted, err)
+		}
 	}
-	if err := client.SetWriteTimeout(time.Duration(t.WriteTimeout)); err != nil {
-		return nil, fmt.Errorf("setting write timeout: %v", err)
+
+	// trace the exchange and let the backend join the trace
+	var span trace.Span
+	ctx, span = startSpan(ctx, r, network, address)
+	injectTraceContext(ctx, env)
+
+	// connect to the backend
+	var conn net.Conn
+	dialStart := time.Now()
+	if t.pools != nil {
+		conn, err = t.pools.DialContext(ctx, network, address)
+	} else {
+		dialer := net.Dialer{Timeout: time.Duration(t.DialTimeout)}
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		if release != nil {
+			release()
+		}
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w: %w", ErrAborted, context.Cause(ctx))
+		} else {
+			scgiMetrics.dialFailures.WithLabelValues(address).Inc()
+			err = fmt.Errorf("dialing backend: %w", err)
+		}
+		endSpan(span, 0, err)
+		return nil, err
 	}
+	span.AddEvent(eventDialed)
 
-	contentLength := r.ContentLength
-	if contentLength == 0 {
-		contentLength, _ = strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64)
+	// track the exchange for metrics and tracing, until the connection
+	// is closed along with the response body or on error
+	stats := &exchangeStats{start: start, dialDuration: time.Since(dialStart)}
+	exchange := &exchangeConn{Conn: conn, ctx: ctx, stats: stats}
+	finish := func(err error) {
+		if release != nil {
+			release()
+		}
+		observeExchange(address, stats)
+		endSpan(span, stats.status, err)
 	}
+	ctx = httptrace.WithClientTrace(ctx, exchangeTrace(span, stats))
 
-	var resp *http.Response
-	switch r.Method {
-	case http.MethodHead:
-		resp, err = client.Head(env)
-	case http.MethodGet:
-		resp, err = client.Get(env, r.Body, contentLength)
-	case http.MethodOptions:
-		resp, err = client.Options(env)
-	default:
-		resp, err = client.Post(env, r.Method, r.Header.Get("Content-Type"), r.Body, contentLength)
+	// create the client that will facilitate the protocol
+	client := &scgi.Client{
+		ReadTimeout:            time.Duration(t.ReadTimeout),
+		WriteTimeout:           time.Duration(t.WriteTimeout),
+		ResponseMode:           t.ResponseMode,
+		MaxResponseHeaderBytes: t.MaxResponseHeaderBytes,
+		Logger:                 logger,
 	}
+	if t.CaptureStderr {
+		client.StderrHeader = t.StderrHeader
+	}
+
+	req := r.WithContext(ctx)
+	req.ContentLength = contentLength
+	if spool != nil {
+		req.Body = io.NopCloser(spool)
+	}
+
+	stats.writeStart = time.Now()
+	resp, err := client.Exchange(exchange, req, env)
 	if err != nil {
+		// an invalid response header comes from a bad gateway
+		var headerErr *scgi.HeaderError
+		if errors.As(err, &headerErr) {
+			stats.parseError = true
+			err = caddyhttp.Error(http.StatusBadGateway, err)
+		}
+		finish(err)
 		return nil, err
 	}
+	stats.status = resp.StatusCode
+	stats.statusLine = scgi.StatusLine(resp)
+	exchange.onClose = func() { finish(nil) }
+
+	// the response is yet to be handled, so these are
+	// available to header manipulations and matchers
+	repl.Set(placeholderPrefix+"dial_duration", stats.dialDuration)
+	repl.Set(placeholderPrefix+"write_duration", stats.writeDuration)
+	repl.Set(placeholderPrefix+"ttfb", stats.ttfb)
+	repl.Set(placeholderPrefix+"upstream_status_line", stats.statusLine)
+
+	// health checks judge the upstream's own response
+	if healthCheck {
+		if t.HealthCheck != nil {
+			return t.HealthCheck.check(resp)
+		}
+		return resp, nil
+	}
+
+	if t.MaxLocalRedirects > 0 && isLocalRedirect(resp, stats.statusLine == "") {
+		resp.Body.Close()
+		return t.localRedirect(r, resp.Header.Get("Location"))
+	}
+
+	if t.fileServer != nil {
+		root, err := caddy.FastAbs(repl.ReplaceAll(t.SendfileRoot, "."))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		name, ok, err := sendfilePath(resp, root)
+		if ok {
+			resp.Body.Close()
+			if err != nil {
+				return t.sendfileFailed(r, err)
+			}
+			return t.sendfile(r, resp, name)
+		}
+	}
 
 	return resp, nil
 }
 
+// requestError is an error caused by the request itself. It is answered
+// with a response of its status code before reaching the upstream, rather
+// than reported as a failure of the upstream.
+type requestError interface {
+	error
+	StatusCode() int
+}
+
+// rejectRequest returns a response turning r away if err is a requestError.
+func (t Transport) rejectRequest(r *http.Request, err error) (*http.Response, bool) {
+	var reqErr requestError
+	if !errors.As(err, &reqErr) {
+		return nil, false
+	}
+
+	status := reqErr.StatusCode()
+	level := zapcore.DebugLevel
+	if status >= 500 {
+		level = zapcore.ErrorLevel
+	}
+	if c := t.logger.Check(level, "rejecting request"); c != nil {
+		c.Write(zap.Int("status", status), zap.Error(err))
+	}
+	return statusResponse(r, status), true
+}
+
+// envVarsSize is the number of variables buildEnv sets
+// before adding those from the config and the headers.
+const envVarsSize = 28
+
 // buildEnv returns a set of CGI environment variables for the request.
 func (t Transport) buildEnv(r *http.Request) (envVars, error) {
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
@@ -323,35 +693,37 @@ func (t Transport) buildEnv(r *http.Request) (envVars, error) {
 	}
 
 	// Some variables are unused but cleared explicitly to prevent
-	// the parent environment from interfering.
-	env = envVars{
-		// Variables defined in CGI 1.1 spec
-		"AUTH_TYPE":         "", // Not used
-		"CONTENT_LENGTH":    r.Header.Get("Content-Length"),
-		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
-		"GATEWAY_INTERFACE": "CGI/1.1",
-		"PATH_INFO":         pathInfo,
-		"QUERY_STRING":      r.URL.RawQuery,
-		"REMOTE_ADDR":       ip,
-		"REMOTE_HOST":       ip, // For speed, remote host lookups disabled
-		"REMOTE_PORT":       port,
-		"REMOTE_IDENT":      "", // Not used
-		"REMOTE_USER":       authUser,
-		"REQUEST_METHOD":    r.Method,
-		"REQUEST_SCHEME":    requestScheme,
-		"SERVER_NAME":       reqHost,
-		"SERVER_PROTOCOL":   r.Proto,
-		"SERVER_SOFTWARE":   t.serverSoftware,
-
-		// Other variables
-		"DOCUMENT_ROOT":   root,
-		"DOCUMENT_URI":    docURI,
-		"HTTP_HOST":       r.Host, // added here, since not always part of headers
-		"REQUEST_URI":     origReq.URL.RequestURI(),
-		"SCGI":            "1", // Required
-		"SCRIPT_FILENAME": scriptFilename,
-		"SCRIPT_NAME":     scriptName,
-	}
+	// the parent environment from interfering. The map is sized up front
+	// for the variables set below and the headers, as growing it while
+	// they are added would reallocate it several times.
+	env = make(envVars, envVarsSize+len(t.EnvVars)+len(r.Header))
+
+	// Variables defined in CGI 1.1 spec
+	env["AUTH_TYPE"] = "" // Not used
+	env["CONTENT_LENGTH"] = r.Header.Get("Content-Length")
+	env["CONTENT_TYPE"] = r.Header.Get("Content-Type")
+	env["GATEWAY_INTERFACE"] = "CGI/1.1"
+	env["PATH_INFO"] = pathInfo
+	env["QUERY_STRING"] = r.URL.RawQuery
+	env["REMOTE_ADDR"] = ip
+	env["REMOTE_HOST"] = ip // For speed, remote host lookups disabled
+	env["REMOTE_PORT"] = port
+	env["REMOTE_IDENT"] = "" // Not used
+	env["REMOTE_USER"] = authUser
+	env["REQUEST_METHOD"] = r.Method
+	env["REQUEST_SCHEME"] = requestScheme
+	env["SERVER_NAME"] = reqHost
+	env["SERVER_PROTOCOL"] = r.Proto
+	env["SERVER_SOFTWARE"] = t.serverSoftware
+
+	// Other variables
+	env["DOCUMENT_ROOT"] = root
+	env["DOCUMENT_URI"] = docURI
+	env["HTTP_HOST"] = r.Host // added here, since not always part of headers
+	env["REQUEST_URI"] = origReq.URL.RequestURI()
+	env["SCGI"] = "1" // Required
+	env["SCRIPT_FILENAME"] = scriptFilename
+	env["SCRIPT_NAME"] = scriptName
 
 	// compliance with the CGI specification requires that
 	// PATH_TRANSLATED should only exist if PATH_INFO is defined.
@@ -395,15 +767,84 @@ func (t Transport) buildEnv(r *http.Request) (envVars, error) {
 		env[key] = repl.ReplaceAll(value, "")
 	}
 
-	// Add all HTTP headers to env variables
-	for field, val := range r.Header {
-		header := strings.ToUpper(field)
-		header = headerNameReplacer.Replace(header)
-		env["HTTP_"+header] = strings.Join(val, ", ")
+	// Add all HTTP headers to env variables, except those denied
+	if err := addHeaderEnv(env, r.Header, t.deniedVars, t.UnderscoreHeaders); err != nil {
+		return nil, err
 	}
 	return env, nil
 }
 
+// defaultDeniedVars are the header-derived variables that are denied when no
+// other set is given. HTTP_PROXY is denied to mitigate https://httpoxy.org.
+var defaultDeniedVars = map[string]struct{}{"HTTP_PROXY": {}}
+
+// addHeaderEnv adds an HTTP_* variable to env for each header in h, except
+// for variables in denied. Headers with underscores in their names are
+// handled according to the underscoreHeaders mode.
+func addHeaderEnv(env envVars, h http.Header, denied map[string]struct{}, underscoreHeaders string) error {
+	for field, val := range h {
+		if strings.Contains(field, "_") {
+			switch underscoreHeaders {
+			case underscoreHeadersReject:
+				return underscoreHeaderError{field: field}
+			case underscoreHeadersAllow:
+				// the hyphenated header wins, and underscore spellings that
+				// collide with each other are all dropped, regardless of
+				// map order
+				if collidingHeader(h, field) {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+
+		header := strings.ToUpper(field)
+		header = "HTTP_" + headerNameReplacer.Replace(header)
+		if _, ok := denied[header]; ok {
+			continue
+		}
+		env[header] = strings.Join(val, ", ")
+	}
+	return nil
+}
+
+// collidingHeader reports whether another header in h maps
+// to the same variable as field.
+func collidingHeader(h http.Header, field string) bool {
+	for other := range h {
+		if other != field && sameVarName(other, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameVarName reports whether the header names a and b map
+// to the same variable name.
+func sameVarName(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range len(a) {
+		if varNameByte(a[i]) != varNameByte(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// varNameByte returns c as it appears in a variable name.
+func varNameByte(c byte) byte {
+	switch {
+	case c == '-', c == ' ':
+		return '_'
+	case 'a' <= c && c <= 'z':
+		return c - ('a' - 'A')
+	}
+	return c
+}
+
 var splitSearchNonASCII = search.New(language.Und, search.IgnoreCase)
 
 // splitPos returns the index where path should
@@ -506,10 +947,34 @@ var tlsProtocolStrings = map[uint16]string{
 
 var headerNameReplacer = strings.NewReplacer(" ", "_", "-", "_")
 
+// underscoreHeaderError is returned for a request header with an
+// underscore in its name if such headers are rejected.
+type underscoreHeaderError struct {
+	field string
+}
+
+func (e underscoreHeaderError) Error() string {
+	return "header name contains underscore: " + e.field
+}
+
+// StatusCode returns 400 Bad Request, as the client sent the header.
+func (underscoreHeaderError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// Modes for handling request headers with underscores in their names.
+const (
+	underscoreHeadersDrop   = "drop"
+	underscoreHeadersReject = "reject"
+	underscoreHeadersAllow  = "allow"
+)
+
 // Interface guards
 var (
 	_ zapcore.ObjectMarshaler = (*loggableEnv)(nil)
 
-	_ caddy.Provisioner = (*Transport)(nil)
-	_ http.RoundTripper = (*Transport)(nil)
+	_ caddy.Provisioner                                = (*Transport)(nil)
+	_ caddy.CleanerUpper                               = (*Transport)(nil)
+	_ http.RoundTripper                                = (*Transport)(nil)
+	_ reverseproxy.HealthCheckSchemeOverriderTransport = (*Transport)(nil)
 )
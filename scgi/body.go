@@ -0,0 +1,120 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// contentLengthReader reads a response body of a declared length,
+// reporting io.ErrUnexpectedEOF if the body ends before that.
+// Anything beyond the declared length is ignored.
+type contentLengthReader struct {
+	r      io.Reader
+	length int64
+	n      int64 // bytes remaining
+	logger *zap.Logger
+}
+
+func newContentLengthReader(r io.Reader, length int64, logger *zap.Logger) *contentLengthReader {
+	return &contentLengthReader{r: r, length: length, n: length, logger: logger}
+}
+
+func (l *contentLengthReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n > 0 && (err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)) {
+		if c := l.logger.Check(zapcore.ErrorLevel, "response body shorter than its Content-Length"); c != nil {
+			c.Write(zap.Int64("content_length", l.length), zap.Int64("received", l.length-l.n))
+		}
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// chunkedBody reads a chunked response body, storing the
+// trailer fields that follow the last chunk in trailer.
+type chunkedBody struct {
+	r       io.Reader // the chunked reader
+	rb      *bufio.Reader
+	trailer http.Header
+	done    bool
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	b.done = true
+
+	trailer, err := textproto.NewReader(b.rb).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if err := validateHeader(http.Header(trailer)); err != nil {
+		return n, err
+	}
+	for field, values := range trailer {
+		b.trailer[field] = values
+	}
+	return n, io.EOF
+}
+
+// announcedTrailer returns the trailer of a response with header h,
+// holding the fields announced in its Trailer field with nil values,
+// as with net/http. The Trailer field is removed from h.
+func announcedTrailer(h http.Header) http.Header {
+	trailer := make(http.Header)
+	for _, value := range h.Values("Trailer") {
+		for field := range strings.SplitSeq(value, ",") {
+			if field = textproto.TrimString(field); field != "" {
+				trailer[textproto.CanonicalMIMEHeaderKey(field)] = nil
+			}
+		}
+	}
+	h.Del("Trailer")
+	return trailer
+}
+
+// bodyAllowed reports whether a response with the given status
+// to a request with the given method may have a body.
+func bodyAllowed(method string, status int) bool {
+	switch {
+	case method == http.MethodHead,
+		status >= 100 && status < 200,
+		status == http.StatusNoContent,
+		status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestResponseBodyShorterThanContentLength(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		response string
+	}{
+		{name: "cgi", response: "Status: 200 OK\r\nContent-Length: 10\r\n\r\nhello"},
+		{name: "nph", response: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := rawRoundTrip(t, &Client{}, tt.response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+			if string(body) != "hello" {
+				t.Errorf("got body %q, want %q", body, "hello")
+			}
+		})
+	}
+}
+
+func TestResponseChunkedTrailer(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		response string
+	}{
+		{
+			name: "cgi",
+			response: "Status: 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+				"5\r\nhello\r\n0\r\nX-Checksum: abc123\r\n\r\n",
+		},
+		{
+			name: "nph",
+			response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+				"5\r\nhello\r\n0\r\nX-Checksum: abc123\r\n\r\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := rawRoundTrip(t, &Client{}, tt.response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := resp.Trailer["X-Checksum"]; !ok {
+				t.Errorf("announced trailer is missing from %v", resp.Trailer)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "hello" {
+				t.Errorf("got body %q, want %q", body, "hello")
+			}
+			if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+				t.Errorf("got trailer X-Checksum %q, want %q", got, "abc123")
+			}
+		})
+	}
+}
@@ -0,0 +1,590 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Copyright 2012 Junqing Tan <ivan@mysqlab.net> and The Go Authors
+// Use of this source code is governed by a BSD-style
+// Part of source code is based on Go fcgi package
+
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http/httpguts"
+)
+
+// The ways a response from the scgi responder may be parsed.
+const (
+	// ResponseModeCGI parses responses as CGI responses (RFC 3875
+	// section 6), whose status is given by the Status header field.
+	ResponseModeCGI = "cgi"
+
+	// ResponseModeNPH parses responses as non-parsed header responses,
+	// which are complete HTTP/1.x responses beginning with a status line.
+	ResponseModeNPH = "nph"
+
+	// ResponseModeAuto parses responses beginning with "HTTP/" as
+	// non-parsed header responses, and all others as CGI responses.
+	ResponseModeAuto = "auto"
+)
+
+// ErrAborted is returned when an exchange with the SCGI server is cut
+// short because the client request's context was cancelled. It always
+// wraps the context's cause, e.g. context.Canceled.
+var ErrAborted = errors.New("scgi exchange aborted")
+
+var noopLogger = zap.NewNop()
+
+// client implements a SCGI client, which is a standard for
+// interfacing external applications with Web servers.
+type client struct {
+	rwc    net.Conn
+	ctx    context.Context
+	stop   func() bool
+	trace  *httptrace.ClientTrace // the client trace of the request, if any
+	logger *zap.Logger
+
+	// the response header field carrying messages the scgi
+	// responder wrote to its stderr, if these are captured
+	stderrHeader string
+
+	// how responses are parsed, one of the responseMode constants
+	responseMode string
+
+	// the maximum size of the response header; 0 means the default
+	maxHeaderBytes int64
+
+	// whether the first byte of the response has been read
+	gotFirstByte bool
+}
+
+// aLongTimeAgo is a non-zero time in the past, used to force any
+// blocked reads or writes on the connection to fail immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watch aborts the exchange as soon as ctx is done by forcing the
+// connection's deadlines into the past. It must be called after any
+// read or write timeouts have been set.
+func (c *client) watch(ctx context.Context) {
+	c.ctx = ctx
+	c.trace = httptrace.ContextClientTrace(ctx)
+	c.stop = context.AfterFunc(ctx, func() {
+		_ = c.rwc.SetDeadline(aLongTimeAgo)
+	})
+}
+
+// unwatch stops watching the context passed to watch, if any.
+func (c *client) unwatch() {
+	if c.stop != nil {
+		c.stop()
+	}
+}
+
+// close stops watching the context and closes the connection.
+func (c *client) close() error {
+	c.unwatch()
+	return c.rwc.Close()
+}
+
+// wroteHeaders tells the client trace, if any, that the
+// netstring header has been written.
+func (c *client) wroteHeaders() {
+	if c.trace != nil && c.trace.WroteHeaders != nil {
+		c.trace.WroteHeaders()
+	}
+}
+
+// wroteRequest tells the client trace, if any, that the
+// request has been written in full.
+func (c *client) wroteRequest() {
+	if c.trace != nil && c.trace.WroteRequest != nil {
+		c.trace.WroteRequest(httptrace.WroteRequestInfo{})
+	}
+}
+
+// gotByte tells the client trace, if any, when the
+// first byte of the response has been read.
+func (c *client) gotByte() {
+	if c.gotFirstByte {
+		return
+	}
+	c.gotFirstByte = true
+	if c.trace != nil && c.trace.GotFirstResponseByte != nil {
+		c.trace.GotFirstResponseByte()
+	}
+}
+
+// abortErr returns err classified as ErrAborted if the exchange
+// was aborted because its context is done.
+func (c *client) abortErr(err error) error {
+	if err == nil || c.ctx == nil || c.ctx.Err() == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrAborted, context.Cause(c.ctx))
+}
+
+// Do made the request and returns a io.Reader that translates the data read
+// from scgi responder out of scgi packet before returning it.
+func (c *client) Do(p map[string]string, req io.Reader) (r io.Reader, err error) {
+	// check for CONTENT_LENGTH, since the lack of it or wrong value will cause the backend to hang
+	if clStr, ok := p["CONTENT_LENGTH"]; !ok {
+		return nil, errors.New("missing CONTENT_LENGTH")
+	} else if _, err := strconv.ParseUint(clStr, 10, 64); err != nil {
+		// stdlib won't return a negative Content-Length, but we check just in case,
+		// the most likely cause is from a missing content length, which is -1
+		return nil, fmt.Errorf("invalid CONTENT_LENGTH: %w", err)
+	}
+
+	writer := &streamWriter{c: c}
+	writer.buf = bufPool.Get().(*bytes.Buffer)
+	writer.buf.Reset()
+	defer bufPool.Put(writer.buf)
+
+	err = writer.writeNetstring(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if req != nil {
+		_, err = io.Copy(writer, req)
+		if err != nil {
+			return nil, c.abortErr(err)
+		}
+	}
+	err = writer.FlushStream()
+	if err != nil {
+		return nil, err
+	}
+	c.wroteRequest()
+
+	r = &streamReader{c: c}
+	return r, err
+}
+
+// clientCloser is a io.ReadCloser. It wraps a io.Reader with a Closer
+// that closes the client connection.
+type clientCloser struct {
+	c *client
+	r *streamReader
+	io.Reader
+
+	status     int
+	statusLine string
+	logger     *zap.Logger
+}
+
+func (s clientCloser) Close() error {
+	logStderr(s.logger, s.status, s.r.stderr.Bytes())
+	return s.c.close()
+}
+
+// logStderr logs the messages the scgi responder wrote to its stderr while
+// producing a response with the given status, if any. WARN level is used,
+// or ERROR level if the status is 4xx or 5xx.
+func logStderr(logger *zap.Logger, status int, stderr []byte) {
+	if len(stderr) == 0 {
+		return
+	}
+
+	logLevel := zapcore.WarnLevel
+	if status >= 400 {
+		logLevel = zapcore.ErrorLevel
+	}
+
+	if c := logger.Check(logLevel, "stderr"); c != nil {
+		c.Write(zap.ByteString("body", stderr))
+	}
+}
+
+// max1xxResponses is the maximum number of informational
+// responses accepted before the final response, as in net/http.
+const max1xxResponses = 5
+
+// isInformational reports whether code is the status of an informational
+// response preceding the final one; 101 Switching Protocols is final.
+func isInformational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// upgradedBody is the body of a 101 Switching Protocols response.
+// Reads and writes go straight to the connection to the scgi responder,
+// which makes it usable as a bidirectional tunnel, e.g. for WebSockets.
+type upgradedBody struct {
+	c *client
+	io.Reader
+
+	statusLine string
+}
+
+func (b *upgradedBody) Write(p []byte) (int, error) {
+	n, err := b.c.rwc.Write(p)
+	return n, b.c.abortErr(err)
+}
+
+func (b *upgradedBody) Close() error {
+	return b.c.close()
+}
+
+// Request returns a HTTP Response with Header and Body
+// from scgi responder
+func (c *client) Request(p map[string]string, req io.Reader) (resp *http.Response, err error) {
+	r, err := c.Do(p, req)
+	if err != nil {
+		return resp, err
+	}
+
+	// limit the size of the response header, allowing for what is
+	// buffered beyond it; the limit is lifted once it has been read
+	limit := c.maxHeaderBytes
+	if limit <= 0 {
+		limit = defaultMaxResponseHeaderBytes
+	}
+	hr := &headerReader{r: r, max: limit + bufferSize}
+	rb := bufio.NewReaderSize(hr, bufferSize)
+
+	nph := c.isNPH(rb)
+	if nph {
+		resp, err = c.readNPHResponse(rb, p["REQUEST_METHOD"])
+	} else {
+		resp, err = c.readCGIResponse(rb)
+	}
+	// the header is what was read but isn't buffered for the body; if
+	// reading it failed at the read limit, it would have been larger
+	headerLen := hr.read - int64(rb.Buffered())
+	exceeded := headerLen > limit || err != nil && hr.read >= hr.max
+	if err != nil || exceeded {
+		return resp, c.headerError(headerReadError(err, exceeded, limit, hr.start()))
+	}
+	hr.max = -1
+	statusLine := resp.Header.Get("Status")
+	if nph {
+		statusLine = resp.Proto + " " + resp.Status
+	}
+
+	var body io.Reader
+	if nph {
+		body = resp.Body
+	} else {
+		// TODO: fixTransferEncoding ?
+		resp.TransferEncoding = resp.Header["Transfer-Encoding"]
+		resp.ContentLength = -1
+		if cl, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil && cl >= 0 {
+			resp.ContentLength = cl
+		}
+
+		body = rb
+		if chunked(resp.TransferEncoding) {
+			resp.ContentLength = -1
+			resp.Trailer = announcedTrailer(resp.Header)
+			body = &chunkedBody{r: httputil.NewChunkedReader(rb), rb: rb, trailer: resp.Trailer}
+		}
+	}
+
+	// hold the upstream to the declared length of the body
+	if resp.ContentLength >= 0 && body != http.NoBody &&
+		bodyAllowed(p["REQUEST_METHOD"], resp.StatusCode) {
+		body = newContentLengthReader(body, resp.ContentLength, c.logger)
+	}
+
+	// SCGI has no stderr stream, so the scgi responder may send
+	// its stderr messages in a header field, which isn't passed on
+	stream := r.(*streamReader)
+	if c.stderrHeader != "" {
+		stream.stderr.WriteString(strings.Join(resp.Header.Values(c.stderrHeader), "\n"))
+		resp.Header.Del(c.stderrHeader)
+	}
+
+	// after switching protocols the connection becomes a tunnel
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if c.stderrHeader != "" {
+			logStderr(c.logger, resp.StatusCode, stream.stderr.Bytes())
+		}
+		// the tunnel may stay open indefinitely
+		if err = c.rwc.SetDeadline(time.Time{}); err != nil {
+			return resp, err
+		}
+		resp.ContentLength = -1
+		resp.Body = &upgradedBody{c: c, Reader: rb, statusLine: statusLine}
+		return resp, nil
+	}
+
+	// wrap the response body in our closer
+	closer := clientCloser{
+		c:          c,
+		r:          stream,
+		Reader:     body,
+		status:     resp.StatusCode,
+		statusLine: statusLine,
+		logger:     noopLogger,
+	}
+	if c.stderrHeader != "" {
+		closer.logger = c.logger
+	}
+	resp.Body = closer
+
+	return resp, nil
+}
+
+// headerError logs err if it is due to an invalid response header.
+func (c *client) headerError(err error) error {
+	var headerErr *HeaderError
+	if !errors.As(err, &headerErr) {
+		return err
+	}
+	if ce := c.logger.Check(zapcore.ErrorLevel, "invalid response header"); ce != nil {
+		ce.Write(
+			zap.String("reason", headerErr.reason),
+			zap.ByteString("header", headerErr.data),
+		)
+	}
+	return err
+}
+
+// StatusLine returns the status of resp, a response returned by a Client,
+// as it was received: the status line of a non-parsed header response, or
+// the Status header field of a CGI response. It is empty for a CGI response
+// without a Status field, whose status is implied (RFC 3875 section 6.3.3).
+func StatusLine(resp *http.Response) string {
+	switch body := resp.Body.(type) {
+	case clientCloser:
+		return body.statusLine
+	case *upgradedBody:
+		return body.statusLine
+	}
+	return resp.Header.Get("Status")
+}
+
+// isNPH reports whether the response waiting in rb is to be
+// parsed as a non-parsed header response.
+func (c *client) isNPH(rb *bufio.Reader) bool {
+	switch c.responseMode {
+	case ResponseModeNPH:
+		return true
+	case ResponseModeCGI:
+		return false
+	}
+	prefix, _ := rb.Peek(len("HTTP/"))
+	return string(prefix) == "HTTP/"
+}
+
+// readCGIResponse reads the header of a CGI response (RFC 3875 section 6)
+// from rb, whose status is given by the Status header field, if any.
+func (c *client) readCGIResponse(rb *bufio.Reader) (resp *http.Response, err error) {
+	tp := textproto.NewReader(rb)
+
+	// Parse the response headers. Any informational (1xx) responses
+	// preceding the final one are passed on to the client trace.
+	for num1xx := 0; ; num1xx++ {
+		resp = &http.Response{
+			Status:     "200 OK",
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			StatusCode: http.StatusOK,
+		}
+
+		// a header cut short by the end of the stream is accepted,
+		// as long as it is that of a final response
+		mimeHeader, readErr := tp.ReadMIMEHeader()
+		if readErr != nil && readErr != io.EOF {
+			return resp, readErr
+		}
+		resp.Header = http.Header(mimeHeader)
+
+		if status := resp.Header.Get("Status"); status != "" {
+			resp.StatusCode, resp.Status, err = parseStatus(status)
+			if err != nil {
+				return resp, err
+			}
+		}
+		if err = validateHeader(resp.Header); err != nil {
+			return resp, err
+		}
+
+		if readErr == io.EOF && (isInformational(resp.StatusCode) || num1xx > 0 && len(mimeHeader) == 0) {
+			return resp, io.ErrUnexpectedEOF
+		}
+		if !isInformational(resp.StatusCode) {
+			return resp, nil
+		}
+		resp.Header.Del("Status")
+		if err = c.got1xxResponse(num1xx, resp); err != nil {
+			return resp, err
+		}
+	}
+}
+
+// readNPHResponse reads the header of a non-parsed header response from rb,
+// which is a complete HTTP/1.x response beginning with a status line. The
+// response body handles its framing, i.e. chunking, trailers and
+// Content-Length. method is the request method.
+func (c *client) readNPHResponse(rb *bufio.Reader, method string) (resp *http.Response, err error) {
+	req := &http.Request{Method: method}
+
+	for num1xx := 0; ; num1xx++ {
+		resp, err = http.ReadResponse(rb, req)
+		if err != nil {
+			return resp, err
+		}
+		if _, ok := parseStatusCode(strconv.Itoa(resp.StatusCode)); !ok {
+			return resp, newHeaderError("invalid status", []byte(resp.Status))
+		}
+		if err = validateHeader(resp.Header); err != nil {
+			return resp, err
+		}
+
+		if !isInformational(resp.StatusCode) {
+			return resp, nil
+		}
+		if err = c.got1xxResponse(num1xx, resp); err != nil {
+			return resp, err
+		}
+	}
+}
+
+// got1xxResponse passes the num1xx'th informational response resp on to
+// the client trace of the request, if any.
+func (c *client) got1xxResponse(num1xx int, resp *http.Response) error {
+	if num1xx >= max1xxResponses {
+		return errors.New("too many 1xx informational responses")
+	}
+	if c.trace != nil && c.trace.Got1xxResponse != nil {
+		return c.trace.Got1xxResponse(resp.StatusCode, textproto.MIMEHeader(resp.Header))
+	}
+	return nil
+}
+
+// roundTrip issues r to the scgi responder with the environment p, picking
+// the method used to send body according to the request method.
+//
+// A 101 Switching Protocols response is only accepted if r asked for
+// a protocol upgrade; its body is then an io.ReadWriteCloser.
+func (c *client) roundTrip(r *http.Request, p map[string]string, body io.Reader, l int64) (resp *http.Response, err error) {
+	switch r.Method {
+	case http.MethodHead:
+		resp, err = c.Head(p)
+	case http.MethodGet:
+		resp, err = c.Get(p, body, l)
+	case http.MethodOptions:
+		resp, err = c.Options(p)
+	default:
+		resp, err = c.Post(p, r.Method, r.Header.Get("Content-Type"), body, l)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols && !isUpgradeRequest(r) {
+		resp.Body.Close()
+		return nil, errors.New("scgi responder switched protocols without an upgrade request")
+	}
+	return resp, nil
+}
+
+// isUpgradeRequest reports whether r asks for a protocol upgrade.
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade")
+}
+
+// Get issues a GET request to the scgi responder.
+func (c *client) Get(p map[string]string, body io.Reader, l int64) (resp *http.Response, err error) {
+	p["REQUEST_METHOD"] = "GET"
+	p["CONTENT_LENGTH"] = strconv.FormatInt(l, 10)
+
+	return c.Request(p, body)
+}
+
+// Head issues a HEAD request to the scgi responder.
+func (c *client) Head(p map[string]string) (resp *http.Response, err error) {
+	p["REQUEST_METHOD"] = "HEAD"
+	p["CONTENT_LENGTH"] = "0"
+
+	return c.Request(p, nil)
+}
+
+// Options issues an OPTIONS request to the scgi responder.
+func (c *client) Options(p map[string]string) (resp *http.Response, err error) {
+	p["REQUEST_METHOD"] = "OPTIONS"
+	p["CONTENT_LENGTH"] = "0"
+
+	return c.Request(p, nil)
+}
+
+// Post issues a POST request to the scgi responder. with request body
+// in the format that bodyType specified
+func (c *client) Post(p map[string]string, method string, bodyType string, body io.Reader, l int64) (resp *http.Response, err error) {
+	if p == nil {
+		p = make(map[string]string)
+	}
+
+	p["REQUEST_METHOD"] = strings.ToUpper(method)
+
+	if len(p["REQUEST_METHOD"]) == 0 || p["REQUEST_METHOD"] == "GET" {
+		p["REQUEST_METHOD"] = "POST"
+	}
+
+	p["CONTENT_LENGTH"] = strconv.FormatInt(l, 10)
+	if len(bodyType) > 0 {
+		p["CONTENT_TYPE"] = bodyType
+	} else {
+		p["CONTENT_TYPE"] = "application/x-www-form-urlencoded"
+	}
+
+	return c.Request(p, body)
+}
+
+// PostForm issues a POST to the scgi responder, with form
+// as a string key to a list values (url.Values)
+func (c *client) PostForm(p map[string]string, data url.Values) (resp *http.Response, err error) {
+	body := bytes.NewReader([]byte(data.Encode()))
+	return c.Post(p, "POST", "application/x-www-form-urlencoded", body, int64(body.Len()))
+}
+
+// SetReadTimeout sets the read timeout for future calls that read from the
+// scgi responder. A zero value for t means no timeout will be set.
+func (c *client) SetReadTimeout(t time.Duration) error {
+	if t != 0 {
+		return c.rwc.SetReadDeadline(time.Now().Add(t))
+	}
+	return nil
+}
+
+// SetWriteTimeout sets the write timeout for future calls that send data to
+// the scgi responder. A zero value for t means no timeout will be set.
+func (c *client) SetWriteTimeout(t time.Duration) error {
+	if t != 0 {
+		return c.rwc.SetWriteDeadline(time.Now().Add(t))
+	}
+	return nil
+}
+
+// Checks whether chunked is part of the encodings stack
+func chunked(te []string) bool { return len(te) > 0 && te[0] == "chunked" }
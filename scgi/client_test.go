@@ -0,0 +1,258 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newRawServer answers every SCGI request on a local TCP port with the
+// raw bytes of response, then closes the connection.
+func newRawServer(t *testing.T, response string) net.Addr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := readNetstring(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				io.WriteString(conn, response)
+			}()
+		}
+	}()
+	return l.Addr()
+}
+
+// rawRoundTrip sends a GET request to a server answering with response.
+func rawRoundTrip(t *testing.T, client *Client, response string) (*http.Response, error) {
+	t.Helper()
+	client.Network, client.Address = "tcp", newRawServer(t, response).String()
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.RoundTrip(req)
+	if err == nil {
+		t.Cleanup(func() { resp.Body.Close() })
+	}
+	return resp, err
+}
+
+func TestReadCGIResponseEOF(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		response   string
+		wantStatus int
+		wantErr    error
+	}{
+		{
+			name:     "closed after informational response",
+			response: "Status: 103 Early Hints\r\nLink: </style.css>\r\n\r\n",
+			wantErr:  io.ErrUnexpectedEOF,
+		},
+		{
+			name:     "informational response cut short",
+			response: "Status: 103 Early Hints\r\nLink: </style.css>\r\n",
+			wantErr:  io.ErrUnexpectedEOF,
+		},
+		{
+			name:       "final response cut short",
+			response:   "Status: 404 Not Found\r\n",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "final response cut short after informational response",
+			response:   "Status: 103 Early Hints\r\n\r\nStatus: 404 Not Found\r\n",
+			wantStatus: http.StatusNotFound,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := rawRoundTrip(t, &Client{ResponseMode: ResponseModeCGI}, tt.response)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{name: "cgi", response: "Status: 404 Not Found\r\n\r\n", want: "404 Not Found"},
+		{name: "cgi custom reason", response: "Status: 404 Gone Fishing\r\n\r\n", want: "404 Gone Fishing"},
+		{name: "cgi without reason", response: "Status: 404\r\n\r\n", want: "404 Not Found"},
+		{name: "cgi implied", response: "Content-Type: text/plain\r\n\r\n", want: "200 OK"},
+		{name: "nph", response: "HTTP/1.1 404 Not Found\r\n\r\n", want: "404 Not Found"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := rawRoundTrip(t, &Client{}, tt.response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != tt.want {
+				t.Errorf("got status %q, want %q", resp.Status, tt.want)
+			}
+		})
+	}
+}
+
+// paddedHeader returns a response header starting with prefix
+// that is exactly n bytes long, including the blank line ending it.
+func paddedHeader(prefix string, n int) string {
+	const field, end = "X-Pad: ", "\r\n\r\n"
+	return prefix + field + strings.Repeat("a", n-len(prefix)-len(field)-len(end)) + end
+}
+
+func TestResponseHeaderLimit(t *testing.T) {
+	const limit = 128
+	// a body well beyond the read buffer is read ahead with the header
+	body := strings.Repeat("b", 2*bufferSize)
+
+	for _, tt := range []struct {
+		name   string
+		prefix string
+	}{
+		{name: "cgi", prefix: "Status: 200 OK\r\n"},
+		{name: "nph", prefix: "HTTP/1.1 200 OK\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{MaxResponseHeaderBytes: limit}
+
+			resp, err := rawRoundTrip(t, client, paddedHeader(tt.prefix, limit)+body)
+			if err != nil {
+				t.Fatalf("header of exactly %d bytes: %v", limit, err)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil || string(got) != body {
+				t.Errorf("got %d bytes of body (error: %v), want %d", len(got), err, len(body))
+			}
+
+			_, err = rawRoundTrip(t, client, paddedHeader(tt.prefix, limit+1)+body)
+			var headerErr *HeaderError
+			if !errors.As(err, &headerErr) || !strings.Contains(headerErr.reason, "exceeds") {
+				t.Fatalf("header of %d bytes: got error %v, want it to exceed the limit", limit+1, err)
+			}
+			if !strings.HasPrefix(string(headerErr.data), tt.prefix+"X-Pad: aaa") {
+				t.Errorf("got offending bytes %q, want the start of the header", headerErr.data)
+			}
+		})
+	}
+}
+
+func TestResponseHeaderLimitQuotesStart(t *testing.T) {
+	header := paddedHeader("Status: 200 OK\r\n", 64<<10)
+	_, err := rawRoundTrip(t, &Client{MaxResponseHeaderBytes: 1024}, header)
+
+	var headerErr *HeaderError
+	if !errors.As(err, &headerErr) {
+		t.Fatalf("got error %v, want an invalid header error", err)
+	}
+	if want := header[:maxLoggedHeaderBytes]; string(headerErr.data) != want {
+		t.Errorf("got offending bytes %q, want %q", headerErr.data, want)
+	}
+}
+
+func TestRoundTripSwitchingProtocols(t *testing.T) {
+	const response = "Status: 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		if _, err := readNetstring(br); err != nil {
+			return
+		}
+		io.WriteString(conn, response)
+		// echo whatever comes through the tunnel
+		io.Copy(conn, br)
+	}()
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+
+	client := &Client{Network: "tcp", Address: l.Addr().String()}
+	resp, err := client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	tunnel, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		t.Fatalf("got body of type %T, want an io.ReadWriteCloser", resp.Body)
+	}
+
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := io.WriteString(tunnel, msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(tunnel, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Errorf("got %q through the tunnel, want %q", got, msg)
+		}
+	}
+
+	// without an upgrade request, switching protocols is refused
+	_, err = rawRoundTrip(t, &Client{}, response)
+	if err == nil || !strings.Contains(err.Error(), "without an upgrade request") {
+		t.Errorf("got error %v, want switching protocols to be refused", err)
+	}
+}
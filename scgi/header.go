@@ -0,0 +1,155 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// defaultMaxResponseHeaderBytes is the default limit on the
+// size of the response header from the scgi responder.
+const defaultMaxResponseHeaderBytes = 1 << 20
+
+// bufferSize is the size of the buffer the response is read through.
+const bufferSize = 4096
+
+// maxLoggedHeaderBytes is the number of offending
+// header bytes included in errors and logs.
+const maxLoggedHeaderBytes = 256
+
+// HeaderError is returned when the response header from the
+// scgi responder is malformed, invalid or too large.
+type HeaderError struct {
+	reason string
+	data   []byte // offending bytes, truncated
+}
+
+func newHeaderError(reason string, data []byte) *HeaderError {
+	if len(data) > maxLoggedHeaderBytes {
+		data = data[:maxLoggedHeaderBytes]
+	}
+	return &HeaderError{reason: reason, data: data}
+}
+
+func (e *HeaderError) Error() string {
+	if len(e.data) == 0 {
+		return "invalid response header: " + e.reason
+	}
+	return fmt.Sprintf("invalid response header: %s: %q", e.reason, e.data)
+}
+
+// headerReader reads a response header from r, reading at most max bytes
+// unless max is negative, and keeps the first bytes read for errors.
+type headerReader struct {
+	r    io.Reader
+	read int64 // the number of bytes read from r
+	max  int64
+
+	head  [maxLoggedHeaderBytes]byte
+	nhead int
+}
+
+func (h *headerReader) Read(p []byte) (int, error) {
+	if h.max >= 0 {
+		if h.read >= h.max {
+			return 0, io.EOF
+		}
+		p = p[:min(int64(len(p)), h.max-h.read)]
+	}
+	n, err := h.r.Read(p)
+	h.nhead += copy(h.head[h.nhead:], p[:n])
+	h.read += int64(n)
+	return n, err
+}
+
+// start returns the first bytes of the header read so far.
+func (h *headerReader) start() []byte {
+	return h.head[:h.nhead]
+}
+
+// headerReadError classifies err, returned while reading the header of a
+// response, as a *HeaderError unless it is an error reading from the
+// connection. exceeded reports whether the header is larger than limit, in
+// which case err may be nil and the error quotes start, the start of it.
+func headerReadError(err error, exceeded bool, limit int64, start []byte) error {
+	if exceeded {
+		return newHeaderError(fmt.Sprintf("header exceeds %d bytes", limit), start)
+	}
+	var headerErr *HeaderError
+	if errors.As(err, &headerErr) {
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, ErrAborted) || errors.As(err, &netErr) {
+		return err
+	}
+	// textproto and net/http quote the offending line in the error
+	return newHeaderError("malformed header", []byte(err.Error()))
+}
+
+// parseStatus parses the value of a Status header field, which must
+// be a three-digit status code optionally followed by a reason phrase.
+// The status is returned as in http.Response, e.g. "404 Not Found",
+// with the standard reason phrase if there is none.
+func parseStatus(status string) (code int, text string, err error) {
+	codeStr, reason, _ := strings.Cut(status, " ")
+	code, ok := parseStatusCode(codeStr)
+	if !ok {
+		return 0, "", newHeaderError("invalid status", []byte(status))
+	}
+	if reason == "" {
+		reason = http.StatusText(code)
+	}
+	return code, codeStr + " " + reason, nil
+}
+
+// parseStatusCode parses s as a three-digit status code from 100 to 599.
+func parseStatusCode(s string) (int, bool) {
+	if len(s) != 3 {
+		return 0, false
+	}
+	code := 0
+	for i := range len(s) {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+		code = code*10 + int(s[i]-'0')
+	}
+	return code, code >= 100 && code <= 599
+}
+
+// validateHeader checks that all header field names and values in h are
+// valid as per RFC 9110.
+func validateHeader(h http.Header) error {
+	for name, values := range h {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return newHeaderError("invalid field name", []byte(name))
+		}
+		for _, value := range values {
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return newHeaderError("invalid field value", []byte(name+": "+value))
+			}
+		}
+	}
+	return nil
+}
@@ -23,4 +23,4 @@ var bufPool = sync.Pool{
 	New: func() any {
 		return new(bytes.Buffer)
 	},
-}
\ No newline at end of file
+}
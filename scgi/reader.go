@@ -0,0 +1,97 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type streamReader struct {
+	c      *client
+	stderr bytes.Buffer
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	n, err := r.c.rwc.Read(p)
+	if n > 0 {
+		r.c.gotByte()
+	}
+	return n, r.c.abortErr(err)
+}
+
+// maxNetstringLen is the largest netstring header accepted by readNetstring.
+const maxNetstringLen = 1 << 20
+
+var errMalformedNetstring = errors.New("malformed netstring header")
+
+// readNetstring decodes a netstring header as encoded by
+// streamWriter.writeNetstring: the length in decimal, a colon, NUL
+// separated key/value pairs starting with CONTENT_LENGTH, and a comma.
+func readNetstring(r *bufio.Reader) (map[string]string, error) {
+	var n int
+	for digits := 0; ; digits++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == ':' && digits > 0 {
+			break
+		}
+		if c < '0' || c > '9' || n > maxNetstringLen/10 {
+			return nil, fmt.Errorf("%w: invalid length", errMalformedNetstring)
+		}
+		n = n*10 + int(c-'0')
+	}
+	if n > maxNetstringLen {
+		return nil, fmt.Errorf("%w: length %d exceeds limit", errMalformedNetstring, n)
+	}
+
+	b := make([]byte, n+1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[n] != ',' {
+		return nil, fmt.Errorf("%w: missing trailing comma", errMalformedNetstring)
+	}
+	if n == 0 || b[n-1] != 0x00 {
+		return nil, fmt.Errorf("%w: unterminated pair", errMalformedNetstring)
+	}
+
+	fields := strings.Split(string(b[:n-1]), "\x00")
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("%w: key without value", errMalformedNetstring)
+	}
+	if fields[0] != "CONTENT_LENGTH" {
+		return nil, fmt.Errorf("%w: CONTENT_LENGTH must come first", errMalformedNetstring)
+	}
+
+	pairs := make(map[string]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		k, v := fields[i], fields[i+1]
+		if k == "" {
+			return nil, fmt.Errorf("%w: empty key", errMalformedNetstring)
+		}
+		if _, ok := pairs[k]; ok {
+			return nil, fmt.Errorf("%w: duplicate key %s", errMalformedNetstring, k)
+		}
+		pairs[k] = v
+	}
+	return pairs, nil
+}
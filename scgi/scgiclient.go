@@ -0,0 +1,314 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scgi implements the SCGI protocol: a Client that sends requests
+// to SCGI servers, and Serve, which serves a net/http Handler over SCGI.
+// Unlike the Caddy transport built on it, it doesn't depend on Caddy.
+package scgi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Client is an SCGI client that can be used on its own, without Caddy,
+// e.g. from tools, test harnesses and health checkers. It implements
+// http.RoundTripper, so it may be used as the Transport of an http.Client.
+// A Client opens a new connection for every request.
+//
+// The zero value is a usable client that dials the request URL's host
+// over TCP and builds the environment with DefaultEnv.
+type Client struct {
+	// The network and address of the SCGI server, e.g. "unix" and
+	// "/run/app.sock". If Address is empty, the host of the request URL
+	// is dialed over TCP.
+	Network string
+	Address string
+
+	// DialContext connects to the SCGI server. If nil, a net.Dialer
+	// with DialTimeout is used.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Env returns the environment sent to the SCGI server for r.
+	// If nil, DefaultEnv is used.
+	Env func(r *http.Request) (map[string]string, error)
+
+	// The duration used to set a deadline when connecting to the SCGI server.
+	DialTimeout time.Duration
+
+	// The duration used to set a deadline when reading from the SCGI server.
+	ReadTimeout time.Duration
+
+	// The duration used to set a deadline when sending to the SCGI server.
+	WriteTimeout time.Duration
+
+	// How responses are parsed: ResponseModeCGI, ResponseModeNPH or
+	// ResponseModeAuto. If empty, ResponseModeAuto is used.
+	ResponseMode string
+
+	// The maximum size of the response header. If zero, 1 MiB is used.
+	MaxResponseHeaderBytes int64
+
+	// The response header field in which the SCGI server sends the messages
+	// it wrote to its stderr, e.g. "X-SCGI-Stderr". If set, the field is
+	// removed from responses and logged at WARN level, or ERROR level if
+	// the response has a 4xx or 5xx status.
+	StderrHeader string
+
+	// Logger receives debug logs of each request. If nil, nothing is logged.
+	Logger *zap.Logger
+}
+
+// RoundTrip implements http.RoundTripper. The request must have a known
+// content length if it has a body. The request body is always closed,
+// and the connection is closed along with the response body.
+func (c *Client) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		// the body has been sent in full by the time there is a response
+		defer r.Body.Close()
+	}
+
+	contentLength := r.ContentLength
+	if r.Body == nil || r.Body == http.NoBody {
+		contentLength = 0
+	}
+	if contentLength < 0 {
+		return nil, errUnknownLength
+	}
+
+	envFn := c.Env
+	if envFn == nil {
+		envFn = DefaultEnv
+	}
+	env, err := envFn(r)
+	if err != nil {
+		return nil, fmt.Errorf("building environment: %w", err)
+	}
+
+	network, address := c.Network, c.Address
+	if address == "" {
+		network, address = "tcp", r.URL.Host
+	}
+	if network == "" {
+		network = "tcp"
+	}
+
+	if ce := c.logger().Check(zapcore.DebugLevel, "roundtrip"); ce != nil {
+		ce.Write(
+			zap.String("dial", address),
+			zap.Object("env", loggableEnv(env)),
+		)
+	}
+
+	dial := c.DialContext
+	if dial == nil {
+		dialer := &net.Dialer{Timeout: c.DialTimeout}
+		dial = dialer.DialContext
+	}
+	conn, err := dial(r.Context(), network, address)
+	if err != nil {
+		return nil, fmt.Errorf("dialing backend: %w", err)
+	}
+
+	req := *r
+	req.ContentLength = contentLength
+	resp, err := c.Exchange(conn, &req, env)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = r
+
+	return resp, nil
+}
+
+// Exchange sends r with the environment env to the SCGI server over conn,
+// a new connection to it, and returns the response. Unlike RoundTrip, it
+// doesn't build the environment, dial or close the request body, so that
+// these may be done by the caller; r.ContentLength must be the length of
+// the body. conn is closed along with the response body, or before
+// Exchange returns an error. Env, Network, Address, DialContext and
+// DialTimeout are not used.
+//
+// The hooks of an httptrace.ClientTrace in the context of r are called
+// when the header and the request have been written, when the first
+// byte of the response is read, and for each informational response.
+func (c *Client) Exchange(conn net.Conn, r *http.Request, env map[string]string) (resp *http.Response, err error) {
+	if env == nil {
+		env = make(map[string]string)
+	}
+
+	client := &client{
+		rwc:            conn,
+		logger:         c.logger(),
+		responseMode:   c.ResponseMode,
+		maxHeaderBytes: c.MaxResponseHeaderBytes,
+		stderrHeader:   c.StderrHeader,
+	}
+	defer func() {
+		// conn will be closed with the response body unless there's an error
+		if err != nil {
+			client.close()
+		}
+	}()
+
+	if err = client.SetReadTimeout(c.ReadTimeout); err != nil {
+		return nil, fmt.Errorf("setting read timeout: %w", err)
+	}
+	if err = client.SetWriteTimeout(c.WriteTimeout); err != nil {
+		return nil, fmt.Errorf("setting write timeout: %w", err)
+	}
+	// abort blocked reads and writes as soon as the client goes away
+	client.watch(r.Context())
+
+	var body io.Reader = r.Body
+	if r.Body == nil {
+		body = http.NoBody
+	}
+	resp, err = client.roundTrip(r, env, body, r.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = r
+
+	return resp, nil
+}
+
+// logger returns the logger of c, which discards logs if it is nil.
+func (c *Client) logger() *zap.Logger {
+	if c.Logger == nil {
+		return noopLogger
+	}
+	return c.Logger
+}
+
+// errUnknownLength is returned by Client.RoundTrip for a request body of
+// unknown length, as CONTENT_LENGTH must be sent ahead of the body.
+var errUnknownLength = errors.New("scgi: request body of unknown length")
+
+// DefaultEnv returns the CGI environment for a request made with an SCGI
+// Client. Unlike the Caddy transport, it knows nothing of document roots,
+// so SCRIPT_NAME is the request path and PATH_INFO is empty. The Proxy
+// header is never passed on and headers with underscores are dropped.
+func DefaultEnv(r *http.Request) (map[string]string, error) {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	serverName, serverPort, err := net.SplitHostPort(host)
+	if err != nil {
+		serverName = host
+	}
+
+	requestScheme := r.URL.Scheme
+	if requestScheme == "" {
+		requestScheme = "http"
+	}
+	if serverPort == "" {
+		serverPort = "80"
+		if requestScheme == "https" {
+			serverPort = "443"
+		}
+	}
+
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	proto := r.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+
+	contentLength := r.ContentLength
+	if contentLength < 0 {
+		contentLength = 0
+	}
+
+	env := map[string]string{
+		"CONTENT_LENGTH":    strconv.FormatInt(contentLength, 10),
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"PATH_INFO":         "",
+		"QUERY_STRING":      r.URL.RawQuery,
+		"REQUEST_METHOD":    method,
+		"REQUEST_SCHEME":    requestScheme,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"SCGI":              "1",
+		"SCRIPT_NAME":       r.URL.Path,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"SERVER_PROTOCOL":   proto,
+		"SERVER_SOFTWARE":   "scgi-transport",
+		"HTTP_HOST":         host,
+	}
+	if requestScheme == "https" {
+		env["HTTPS"] = "on"
+	}
+	if r.RemoteAddr != "" {
+		ip, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		env["REMOTE_ADDR"] = ip
+		env["REMOTE_HOST"] = ip
+		env["REMOTE_PORT"] = port
+	}
+
+	for field, val := range r.Header {
+		// headers with underscores could be used to spoof those with
+		// hyphens, and HTTP_PROXY is denied to mitigate https://httpoxy.org
+		if strings.Contains(field, "_") {
+			continue
+		}
+		name := "HTTP_" + headerNameReplacer.Replace(strings.ToUpper(field))
+		if name == "HTTP_PROXY" {
+			continue
+		}
+		env[name] = strings.Join(val, ", ")
+	}
+	return env, nil
+}
+
+var headerNameReplacer = strings.NewReplacer(" ", "_", "-", "_")
+
+// loggableEnv is a simple type to allow for speeding up zap log encoding.
+// Credentials are never logged.
+type loggableEnv map[string]string
+
+func (env loggableEnv) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for k, v := range env {
+		switch k {
+		case "HTTP_COOKIE", "HTTP_SET_COOKIE", "HTTP_AUTHORIZATION", "HTTP_PROXY_AUTHORIZATION":
+			v = ""
+		}
+		enc.AddString(k, v)
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ http.RoundTripper       = (*Client)(nil)
+	_ zapcore.ObjectMarshaler = loggableEnv(nil)
+)
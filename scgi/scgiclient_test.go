@@ -0,0 +1,118 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// closeTracker records whether a request body was closed.
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeTracker) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestClientClosesRequestBody(t *testing.T) {
+	l := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+
+	for _, tt := range []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{name: "response", address: l.Addr().String()},
+		{name: "dial error", address: "127.0.0.1:1", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &closeTracker{Reader: strings.NewReader("hello")}
+			req, err := http.NewRequest(http.MethodPost, "http://localhost/", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.ContentLength = 5
+
+			client := &Client{Network: "tcp", Address: tt.address}
+			resp, err := client.RoundTrip(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %t", err, tt.wantErr)
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if !body.closed {
+				t.Error("request body was not closed")
+			}
+		})
+	}
+}
+
+func TestClientUnknownLength(t *testing.T) {
+	l := newTestServer(t, http.NotFoundHandler())
+
+	body := &closeTracker{Reader: strings.NewReader("hello")}
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+
+	client := &Client{Network: "tcp", Address: l.Addr().String()}
+	_, err = client.RoundTrip(req)
+	if !errors.Is(err, errUnknownLength) {
+		t.Errorf("got error %v, want %v", err, errUnknownLength)
+	}
+	if !body.closed {
+		t.Error("request body was not closed")
+	}
+	if n := l.accepted.Load(); n != 0 {
+		t.Errorf("upstream accepted %d connections, want 0", n)
+	}
+}
+
+func TestClientNilEnv(t *testing.T) {
+	l := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			req, err := http.NewRequest(method, "http://localhost/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &Client{
+				Network: "tcp",
+				Address: l.Addr().String(),
+				Env:     func(*http.Request) (map[string]string, error) { return nil, nil },
+			}
+			resp, err := client.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// Part of source code is based on Go fcgi package
+
+package scgi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"strings"
+	"time"
+)
+
+// Serve accepts incoming SCGI connections on the listener l, creating a new
+// goroutine for each. The goroutine reads the request, calls handler to reply
+// to it and closes the connection, as SCGI serves one request per connection.
+// If l is nil, Serve accepts connections from os.Stdin. If handler is nil,
+// http.DefaultServeMux is used.
+func Serve(l net.Listener, handler http.Handler) error {
+	if l == nil {
+		var err error
+		l, err = net.FileListener(os.Stdin)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+	}
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	for {
+		rw, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(rw, handler)
+	}
+}
+
+// ProcessEnv returns SCGI environment variables associated with the request r
+// for which no effort was made to be included in the request itself - the data
+// is hidden in the request's context. As an example, if SCRIPT_FILENAME is set
+// for a request, it will not be found anywhere in r, but it will be included in
+// ProcessEnv's response (via r's context).
+func ProcessEnv(r *http.Request) map[string]string {
+	env, _ := r.Context().Value(envVarsContextKey{}).(map[string]string)
+	return env
+}
+
+// envVarsContextKey uniquely identifies a mapping of CGI
+// environment variables to their values in a request context.
+type envVarsContextKey struct{}
+
+// serveConn serves the single request sent on conn and closes it.
+func serveConn(conn net.Conn, handler http.Handler) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	w := &response{header: http.Header{}, w: bufio.NewWriter(conn)}
+
+	params, err := readNetstring(br)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(nil)
+		w.w.Flush()
+		return
+	}
+
+	req, err := cgi.RequestFromMap(params)
+	if err != nil {
+		// there was an error reading the request
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		body := io.LimitReader(br, max(req.ContentLength, 0))
+		req.Body = io.NopCloser(body)
+		if req.ContentLength <= 0 {
+			req.Body = http.NoBody
+		}
+		ctx := context.WithValue(req.Context(), envVarsContextKey{}, filterOutUsedEnvVars(params))
+		handler.ServeHTTP(w, req.WithContext(ctx))
+
+		// Consume the rest of the body, so the web server isn't
+		// still writing to us when we close the connection.
+		io.CopyN(io.Discard, body, 100<<20)
+	}
+
+	// Make sure we serve something even if nothing was written to w
+	w.Write(nil)
+	w.w.Flush()
+}
+
+// filterOutUsedEnvVars returns a new map of env vars without the
+// variables in the given envVars map that are read for creating each http.Request
+func filterOutUsedEnvVars(envVars map[string]string) map[string]string {
+	withoutUsedEnvVars := make(map[string]string)
+	for k, v := range envVars {
+		switch k {
+		case "CONTENT_LENGTH", "CONTENT_TYPE", "HTTPS", "REMOTE_ADDR",
+			"REMOTE_PORT", "REQUEST_METHOD", "REQUEST_URI", "SERVER_PROTOCOL":
+			continue
+		}
+		if strings.HasPrefix(k, "HTTP_") {
+			continue
+		}
+		withoutUsedEnvVars[k] = v
+	}
+	return withoutUsedEnvVars
+}
+
+// response implements http.ResponseWriter, writing the
+// response back to the web server in CGI format.
+type response struct {
+	header         http.Header
+	code           int
+	wroteHeader    bool
+	wroteCGIHeader bool
+	w              *bufio.Writer
+}
+
+func (r *response) Header() http.Header {
+	return r.header
+}
+
+func (r *response) Write(p []byte) (n int, err error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.wroteCGIHeader {
+		r.writeCGIHeader(p)
+	}
+	return r.w.Write(p)
+}
+
+func (r *response) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	// informational responses go out right away and leave the final
+	// response open, e.g. for 103 Early Hints
+	if isInformational(code) {
+		r.writeInformational(code)
+		return
+	}
+	r.wroteHeader = true
+	r.code = code
+	if code == http.StatusNotModified {
+		// Must not have body.
+		r.header.Del("Content-Type")
+		r.header.Del("Content-Length")
+		r.header.Del("Transfer-Encoding")
+	}
+	if r.header.Get("Date") == "" {
+		r.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+}
+
+// writeInformational writes an informational response with the current
+// header fields to the output, ahead of the final response.
+func (r *response) writeInformational(code int) {
+	fmt.Fprintf(r.w, "Status: %d %s\r\n", code, http.StatusText(code))
+	r.header.Write(r.w)
+	r.w.WriteString("\r\n")
+	r.w.Flush()
+}
+
+// writeCGIHeader finalizes the header sent to the web server and writes it to
+// the output. p is not written by writeCGIHeader, but is the first chunk of the
+// body that will be written. It is sniffed for a Content-Type if none is set
+// explicitly.
+func (r *response) writeCGIHeader(p []byte) {
+	if r.wroteCGIHeader {
+		return
+	}
+	r.wroteCGIHeader = true
+	fmt.Fprintf(r.w, "Status: %d %s\r\n", r.code, http.StatusText(r.code))
+	if _, hasType := r.header["Content-Type"]; r.code != http.StatusNotModified && !hasType {
+		r.header.Set("Content-Type", http.DetectContentType(p))
+	}
+	r.header.Write(r.w)
+	r.w.WriteString("\r\n")
+	r.w.Flush()
+}
+
+func (r *response) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.wroteCGIHeader {
+		r.writeCGIHeader(nil)
+	}
+	r.w.Flush()
+}
+
+// Interface guards
+var (
+	_ http.ResponseWriter = (*response)(nil)
+	_ http.Flusher        = (*response)(nil)
+)
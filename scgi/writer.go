@@ -0,0 +1,226 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"bytes"
+	"iter"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxWrite is the largest chunk of request body data
+// sent to the SCGI server in a single write.
+const maxWrite = 65536
+
+// streamWriter abstracts out the separation of a stream into discrete netstrings.
+// The header is held in buf until the first chunk of the request body is written
+// so that both can go out in a single vectored write. Body data itself is never
+// buffered and is written at most maxWrite bytes at a time.
+type streamWriter struct {
+	c   *client
+	buf *bytes.Buffer
+	vec [2][]byte
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	nn := 0
+	for len(p) > 0 {
+		n := min(len(p), maxWrite)
+		if err := w.write(p[:n]); err != nil {
+			return nn, err
+		}
+		nn += n
+		p = p[n:]
+	}
+	return nn, nil
+}
+
+// write sends any buffered data followed by p to the underlying connection.
+// Only the write carrying the header is vectored, as net.Buffers escapes to
+// the heap; the rest of the body is written without allocating.
+func (w *streamWriter) write(p []byte) error {
+	if w.buf.Len() == 0 {
+		_, err := w.c.rwc.Write(p)
+		return w.c.abortErr(err)
+	}
+
+	bufs := net.Buffers(w.vec[:0])
+	bufs = append(bufs, w.buf.Bytes(), p)
+
+	_, err := bufs.WriteTo(w.c.rwc)
+	w.buf.Reset()
+	if err == nil {
+		w.c.wroteHeaders()
+	}
+	return w.c.abortErr(err)
+}
+
+// writeNetstring encodes pairs as the netstring header into buf. The length
+// is computed up front so that pairs can be encoded in place in one pass.
+func (w *streamWriter) writeNetstring(pairs map[string]string) error {
+	keys := orderedKeys(pairs)
+
+	nn := 0
+	for _, k := range keys {
+		v := pairs[k]
+		if err := checkPair(k, v); err != nil {
+			return err
+		}
+		nn += len(k) + len(v) + 2
+	}
+
+	// write the netstring
+	w.buf.Grow(nn + 22)
+	w.buf.Write(strconv.AppendInt(w.buf.AvailableBuffer(), int64(nn), 10))
+	w.buf.WriteByte(':')
+	for _, k := range keys {
+		w.buf.WriteString(k)
+		w.buf.WriteByte(0x00)
+		w.buf.WriteString(pairs[k])
+		w.buf.WriteByte(0x00)
+	}
+	w.buf.WriteByte(',')
+
+	return nil
+}
+
+// leadingVars are encoded first, in this order, ahead of all other variables
+// which follow sorted by name. The SCGI spec requires CONTENT_LENGTH to come
+// first; the CGI/1.1 meta-variables are listed as in RFC 3875 section 4.1.
+var leadingVars = []string{
+	"CONTENT_LENGTH",
+	"SCGI",
+	"AUTH_TYPE",
+	"CONTENT_TYPE",
+	"GATEWAY_INTERFACE",
+	"PATH_INFO",
+	"PATH_TRANSLATED",
+	"QUERY_STRING",
+	"REMOTE_ADDR",
+	"REMOTE_HOST",
+	"REMOTE_IDENT",
+	"REMOTE_USER",
+	"REQUEST_METHOD",
+	"SCRIPT_NAME",
+	"SERVER_NAME",
+	"SERVER_PORT",
+	"SERVER_PROTOCOL",
+	"SERVER_SOFTWARE",
+}
+
+// orderedKeys returns the keys of pairs in a stable order, so the
+// same environment always produces the same netstring.
+func orderedKeys(pairs map[string]string) []string {
+	keys := make([]string, 0, len(pairs))
+	for _, k := range leadingVars {
+		if _, ok := pairs[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+
+	n := len(keys)
+	notLeading := func(k string, _ string) bool { return !slices.Contains(leadingVars, k) }
+	for k := range Filter2(maps.All(pairs), notLeading) {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys[n:])
+
+	return keys
+}
+
+// EnvError is returned when an environment variable cannot be encoded
+// in the netstring header. Keys and values are separated by NUL bytes,
+// so a NUL within either (or an empty key) would corrupt the header
+// framing and could be used to inject additional variables.
+type EnvError struct {
+	// Key is the name of the offending variable.
+	Key string
+
+	// InKey reports whether the key, rather than the value, is invalid.
+	InKey bool
+}
+
+func (e *EnvError) Error() string {
+	if e.InKey {
+		return "invalid environment variable name: " + strconv.Quote(e.Key)
+	}
+	return "environment variable " + e.Key + " contains NUL byte"
+}
+
+// StatusCode returns the HTTP status code appropriate for e. Values are
+// generally derived from the request (headers, paths, placeholders), so
+// they are the client's fault; keys only come from configuration.
+func (e *EnvError) StatusCode() int {
+	if e.InKey {
+		return http.StatusBadGateway
+	}
+	return http.StatusBadRequest
+}
+
+// checkPair ensures k and v can be safely encoded in the netstring header.
+func checkPair(k, v string) error {
+	if k == "" || strings.IndexByte(k, 0x00) >= 0 {
+		return &EnvError{Key: k, InKey: true}
+	}
+	if strings.IndexByte(v, 0x00) >= 0 {
+		return &EnvError{Key: k}
+	}
+	return nil
+}
+
+// CheckEnv returns an *EnvError if a variable of env cannot be
+// safely encoded in the netstring header.
+func CheckEnv(env map[string]string) error {
+	for k, v := range env {
+		if err := checkPair(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes buffered data to the underlying connection
+func (w *streamWriter) Flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.buf.WriteTo(w.c.rwc)
+	if err == nil {
+		w.c.wroteHeaders()
+	}
+	return w.c.abortErr(err)
+}
+
+// FlushStream flush data then end current stream
+func (w *streamWriter) FlushStream() error {
+	return w.Flush()
+}
+
+// Filter returns an iterator composed of the pairs of seq that
+// satisfy predicate p.
+func Filter2[K, V any](seq iter.Seq2[K, V], p func(K, V) bool) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for k, v := range seq {
+			if p(k, v) && !yield(k, v) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// countingConn is a net.Conn that discards everything written to it,
+// keeping track of the number of bytes and the largest single write.
+type countingConn struct {
+	net.Conn
+	n       int64
+	largest int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	c.largest = max(c.largest, len(p))
+	return len(p), nil
+}
+
+// sizedReader produces n bytes of body data, handing out a
+// preallocated chunk at a time so it allocates nothing itself.
+type sizedReader struct {
+	n     int64
+	chunk []byte
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunk[:min(int64(len(r.chunk)), r.n)])
+	r.n -= int64(n)
+	return n, nil
+}
+
+func (r *sizedReader) WriteTo(w io.Writer) (int64, error) {
+	var nn int64
+	for r.n > 0 {
+		n, err := w.Write(r.chunk[:min(int64(len(r.chunk)), r.n)])
+		nn += int64(n)
+		r.n -= int64(n)
+		if err != nil {
+			return nn, err
+		}
+	}
+	return nn, nil
+}
+
+func TestStreamWriterLargeBody(t *testing.T) {
+	for _, size := range []int64{16 << 20, 256 << 20} {
+		t.Run(strconv.FormatInt(size, 10), func(t *testing.T) {
+			conn := &countingConn{}
+			w := &streamWriter{c: &client{rwc: conn}, buf: new(bytes.Buffer)}
+			err := w.writeNetstring(map[string]string{
+				"CONTENT_LENGTH": strconv.FormatInt(size, 10),
+				"SCGI":           "1",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			headerLen := int64(w.buf.Len())
+
+			// chunks larger than maxWrite must be split up
+			body := &sizedReader{n: size, chunk: make([]byte, 4*maxWrite)}
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			n, err := io.Copy(w, body)
+			if err == nil {
+				err = w.FlushStream()
+			}
+
+			runtime.ReadMemStats(&after)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != size {
+				t.Errorf("copied %d bytes, want %d", n, size)
+			}
+			if want := headerLen + size; conn.n != want {
+				t.Errorf("sent %d bytes, want %d", conn.n, want)
+			}
+			if conn.largest > maxWrite {
+				t.Errorf("largest write was %d bytes, want at most %d", conn.largest, maxWrite)
+			}
+			// memory use must not grow with the size of the body
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<10 {
+				t.Errorf("allocated %d bytes while streaming the body, want at most %d", alloc, 64<<10)
+			}
+		})
+	}
+}
+
+func FuzzWriteNetstring(f *testing.F) {
+	f.Add("SCRIPT_NAME", "/index.php", "HTTP_HOST", "example.com")
+	f.Add("QUERY_STRING", "", "HTTP_X_EMPTY", "")
+	f.Add("HTTP_X_INJECT", "a\x00SCRIPT_FILENAME\x00/etc/passwd", "SCGI", "1")
+	f.Add("BAD\x00KEY", "value", "", "value")
+	f.Add("CONTENT_LENGTH", "12", "HTTP_X_COMMA", ",:,")
+	f.Fuzz(func(t *testing.T, k1, v1, k2, v2 string) {
+		pairs := map[string]string{"CONTENT_LENGTH": "0", k1: v1, k2: v2}
+		w := &streamWriter{buf: new(bytes.Buffer)}
+		err := w.writeNetstring(pairs)
+		if envErr := CheckEnv(pairs); envErr != nil {
+			var e *EnvError
+			if !errors.As(err, &e) {
+				t.Fatalf("got error %v, want an EnvError", err)
+			}
+			if w.buf.Len() != 0 {
+				t.Fatalf("wrote %q for an invalid environment", w.buf.Bytes())
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := readNetstring(bufio.NewReader(w.buf))
+		if err != nil {
+			t.Fatalf("reading back %v: %v", pairs, err)
+		}
+		if !maps.Equal(got, pairs) {
+			t.Fatalf("got %q, want %q", got, pairs)
+		}
+	})
+}
+
+// requestEnv is the environment of a typical proxied request.
+var requestEnv = map[string]string{
+	"HTTP_USER_AGENT":   "curl/8.0",
+	"SERVER_SOFTWARE":   "Caddy/v2",
+	"REQUEST_URI":       "/index.php/info?a=1",
+	"SCRIPT_FILENAME":   "/srv/index.php",
+	"HTTP_HOST":         "example.com",
+	"CONTENT_TYPE":      "application/x-www-form-urlencoded",
+	"SERVER_PROTOCOL":   "HTTP/1.1",
+	"SERVER_PORT":       "443",
+	"SERVER_NAME":       "example.com",
+	"SCRIPT_NAME":       "/index.php",
+	"REQUEST_METHOD":    "POST",
+	"REMOTE_ADDR":       "192.0.2.1",
+	"QUERY_STRING":      "a=1",
+	"PATH_INFO":         "/info",
+	"GATEWAY_INTERFACE": "CGI/1.1",
+	"DOCUMENT_ROOT":     "/srv",
+	"CONTENT_LENGTH":    "7",
+	"SCGI":              "1",
+	"HTTPS":             "on",
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestWriteNetstringGolden(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		pairs map[string]string
+	}{
+		{
+			name:  "minimal",
+			pairs: map[string]string{"CONTENT_LENGTH": "0", "SCGI": "1"},
+		},
+		{
+			// leading variables in RFC 3875 order, then the rest sorted
+			name:  "request",
+			pairs: requestEnv,
+		},
+		{
+			name: "empty values",
+			pairs: map[string]string{
+				"CONTENT_LENGTH": "0",
+				"SCGI":           "1",
+				"AUTH_TYPE":      "",
+				"QUERY_STRING":   "",
+				"HTTP_X_EMPTY":   "",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &streamWriter{buf: new(bytes.Buffer)}
+			if err := w.writeNetstring(tt.pairs); err != nil {
+				t.Fatal(err)
+			}
+			got := w.buf.Bytes()
+
+			golden := filepath.Join("testdata", strings.ReplaceAll(tt.name, " ", "_")+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// legacyWriteNetstring is the encoder writeNetstring replaced, which built
+// the pairs in a separate strings.Builder and copied them into buf.
+func legacyWriteNetstring(buf *bytes.Buffer, pairs map[string]string) error {
+	var sb strings.Builder
+	nn := 0
+	for _, k := range orderedKeys(pairs) {
+		v := pairs[k]
+		if err := checkPair(k, v); err != nil {
+			return err
+		}
+		n, _ := sb.WriteString(k)
+		sb.WriteByte(0x00)
+		m, _ := sb.WriteString(v)
+		sb.WriteByte(0x00)
+		nn += n + m + 2
+	}
+
+	buf.WriteString(strconv.Itoa(nn))
+	buf.WriteByte(':')
+	buf.WriteString(sb.String())
+	buf.WriteByte(',')
+	return nil
+}
+
+func BenchmarkWriteNetstring(b *testing.B) {
+	b.Run("current", func(b *testing.B) {
+		b.ReportAllocs()
+		w := &streamWriter{buf: new(bytes.Buffer)}
+		for b.Loop() {
+			w.buf.Reset()
+			if err := w.writeNetstring(requestEnv); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := new(bytes.Buffer)
+		for b.Loop() {
+			buf.Reset()
+			if err := legacyWriteNetstring(buf, requestEnv); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
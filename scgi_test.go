@@ -0,0 +1,480 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/Elegant996/scgi-transport/scgi"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// countingListener counts the connections accepted by a net.Listener.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// newTestServer serves h over SCGI on a local TCP port until the end of
+// the test.
+func newTestServer(t *testing.T, h http.Handler) *countingListener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+	go scgi.Serve(cl, h)
+	t.Cleanup(func() { l.Close() })
+	return cl
+}
+
+// newRawServer answers every SCGI request on a local TCP port with the
+// raw bytes of response, then closes the connection.
+func newRawServer(t *testing.T, response string) net.Addr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// skip the netstring header; requests have no body
+				br := bufio.NewReader(conn)
+				size, err := br.ReadString(':')
+				if err != nil {
+					return
+				}
+				n, err := strconv.Atoi(strings.TrimSuffix(size, ":"))
+				if err != nil {
+					return
+				}
+				if _, err := br.Discard(n + 1); err != nil {
+					return
+				}
+				io.WriteString(conn, response)
+			}()
+		}
+	}()
+	return l.Addr()
+}
+
+// newTestTransport provisions tr for the duration of the test.
+func newTestTransport(t testing.TB, tr *Transport) *Transport {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := tr.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Cleanup() })
+	tr.logger = zaptest.NewLogger(t)
+	return tr
+}
+
+// newProxyRequest returns a request to upstream with the context
+// a Caddy server and its reverse proxy give proxied requests.
+func newProxyRequest(method, target string, body io.Reader, upstream net.Addr) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+	ctx = context.WithValue(ctx, caddyhttp.ServerCtxKey, new(caddyhttp.Server))
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{
+		"reverse_proxy.dial_info": reverseproxy.DialInfo{
+			Network: upstream.Network(),
+			Address: upstream.String(),
+		},
+	})
+	ctx = context.WithValue(ctx, caddyhttp.OriginalRequestCtxKey, *req)
+	ctx = context.WithValue(ctx, caddyhttp.ExtraLogFieldsCtxKey, new(caddyhttp.ExtraLogFields))
+	return req.WithContext(ctx)
+}
+
+// unknownLength hides the length of a request body.
+type unknownLength struct{ io.Reader }
+
+func TestRoundTripRejectsBeforeDial(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		tr    *Transport
+		setup func(*http.Request)
+		want  int
+	}{
+		{
+			name: "body of unknown length",
+			tr:   &Transport{},
+			setup: func(req *http.Request) {
+				req.Body = io.NopCloser(unknownLength{strings.NewReader("too large")})
+				req.ContentLength = -1
+			},
+			want: http.StatusLengthRequired,
+		},
+		{
+			name: "body too large to spool",
+			tr:   &Transport{MaxSpoolSize: 4},
+			setup: func(req *http.Request) {
+				req.Body = io.NopCloser(unknownLength{strings.NewReader("too large")})
+				req.ContentLength = -1
+			},
+			want: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "underscore header",
+			tr:   &Transport{UnderscoreHeaders: underscoreHeadersReject},
+			setup: func(req *http.Request) {
+				req.Header["X_Forwarded_For"] = []string{"spoofed"}
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "NUL in header",
+			tr:   &Transport{},
+			setup: func(req *http.Request) {
+				req.Header.Set("X-Inject", "a\x00SCRIPT_FILENAME\x00/etc/passwd")
+			},
+			want: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestServer(t, http.NotFoundHandler())
+			tr := newTestTransport(t, tt.tr)
+
+			req := newProxyRequest(http.MethodPost, "/upload", nil, l.Addr())
+			tt.setup(req)
+
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("got error %v, want a %d response", err, tt.want)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if want := strconv.Itoa(tt.want) + " " + http.StatusText(tt.want); resp.Status != want {
+				t.Errorf("got status %q, want %q", resp.Status, want)
+			}
+			if n := l.accepted.Load(); n != 0 {
+				t.Errorf("upstream accepted %d connections, want 0", n)
+			}
+		})
+	}
+}
+
+func TestRoundTripSpoolsBody(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		size int
+	}{
+		{name: "in memory", size: 4 << 10},
+		{name: "temp file", size: spoolMemoryLimit + 64<<10},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// spool files are created in the default temporary directory
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+
+			var gotLength int64
+			var gotBody []byte
+			l := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotLength = r.ContentLength
+				gotBody, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			tr := newTestTransport(t, &Transport{MaxSpoolSize: 4 << 20})
+
+			body := bytes.Repeat([]byte("0123456789abcdef"), tt.size/16)
+			req := newProxyRequest(http.MethodPost, "/upload", unknownLength{bytes.NewReader(body)}, l.Addr())
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusNoContent)
+			}
+			if gotLength != int64(len(body)) {
+				t.Errorf("got CONTENT_LENGTH %d, want %d", gotLength, len(body))
+			}
+			if !bytes.Equal(gotBody, body) {
+				t.Errorf("backend received %d bytes that differ from the %d sent", len(gotBody), len(body))
+			}
+
+			entries, err := os.ReadDir(tmp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				t.Errorf("spool file %s was not removed", e.Name())
+			}
+		})
+	}
+}
+
+func TestRoundTripCapturesStderr(t *testing.T) {
+	upstream := newRawServer(t, "Status: 500 Internal Server Error\r\n"+
+		"X-SCGI-Stderr: PHP Warning: undefined variable\r\n"+
+		"X-SCGI-Stderr: PHP Fatal error: out of memory\r\n"+
+		"Content-Length: 0\r\n\r\n")
+	tr := newTestTransport(t, &Transport{CaptureStderr: true})
+	core, logs := observer.New(zapcore.DebugLevel)
+	tr.logger = zap.New(core)
+
+	resp, err := tr.RoundTrip(newProxyRequest(http.MethodGet, "/", nil, upstream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := resp.Header.Values(defaultStderrHeader); len(v) > 0 {
+		t.Errorf("got %s %q in the response, want it removed", defaultStderrHeader, v)
+	}
+	resp.Body.Close()
+
+	entries := logs.FilterMessage("stderr").AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("got %d stderr log entries, want 1", len(entries))
+	}
+	if entries[0].Level != zapcore.ErrorLevel {
+		t.Errorf("got level %s, want %s for a 500 response", entries[0].Level, zapcore.ErrorLevel)
+	}
+	want := "PHP Warning: undefined variable\nPHP Fatal error: out of memory"
+	if got, _ := entries[0].ContextMap()["body"].(string); got != want {
+		t.Errorf("got logged stderr %q, want %q", got, want)
+	}
+}
+
+func TestRoundTripSetsPlaceholders(t *testing.T) {
+	l := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	tr := newTestTransport(t, &Transport{Root: "/srv", SplitPath: []string{".php"}})
+
+	req := newProxyRequest(http.MethodGet, "/index.php/info", nil, l.Addr())
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	repl := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	for name, want := range map[string]string{
+		"script_filename":      filepath.FromSlash("/srv/index.php"),
+		"path_info":            "/info",
+		"upstream_status_line": "404 Not Found",
+	} {
+		if got, _ := repl.GetString(placeholderPrefix + name); got != want {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"dial_duration", "write_duration", "ttfb"} {
+		got, _ := repl.Get(placeholderPrefix + name)
+		if d, ok := got.(time.Duration); !ok || d <= 0 {
+			t.Errorf("got %s %v, want a positive duration", name, got)
+		}
+	}
+}
+
+func TestRoundTripAbortedDial(t *testing.T) {
+	l := newTestServer(t, http.NotFoundHandler())
+	tr := newTestTransport(t, &Transport{})
+
+	req := newProxyRequest(http.MethodGet, "/", nil, l.Addr())
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	req = req.WithContext(ctx)
+
+	_, err := tr.RoundTrip(req)
+	if !errors.Is(err, ErrAborted) || !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want ErrAborted wrapping context.Canceled", err)
+	}
+}
+
+func TestAddHeaderEnvUnderscores(t *testing.T) {
+	// X_Forwarded_For collides with X-Forwarded-For once both are
+	// mapped to HTTP_X_FORWARDED_FOR
+	h := http.Header{
+		"X-Forwarded-For": {"trusted"},
+		"X_Forwarded_For": {"spoofed"},
+		"X_Custom":        {"custom"},
+	}
+	// without a hyphenated header, neither underscore spelling may win
+	underscoresOnly := http.Header{
+		"X_Forwarded-For": {"first"},
+		"X-Forwarded_For": {"second"},
+		"X_Custom":        {"custom"},
+	}
+	for _, tt := range []struct {
+		name    string
+		mode    string
+		h       http.Header
+		want    envVars
+		wantErr bool
+	}{
+		{name: "drop", mode: underscoreHeadersDrop, h: h, want: envVars{"HTTP_X_FORWARDED_FOR": "trusted"}},
+		{name: "allow", mode: underscoreHeadersAllow, h: h, want: envVars{"HTTP_X_FORWARDED_FOR": "trusted", "HTTP_X_CUSTOM": "custom"}},
+		{name: "allow colliding underscores", mode: underscoreHeadersAllow, h: underscoresOnly, want: envVars{"HTTP_X_CUSTOM": "custom"}},
+		{name: "reject", mode: underscoreHeadersReject, h: h, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// the outcome must not depend on map iteration order
+			for range 100 {
+				env := envVars{}
+				err := addHeaderEnv(env, tt.h, nil, tt.mode)
+				if tt.wantErr {
+					var reqErr requestError
+					if !errors.As(err, &reqErr) || reqErr.StatusCode() != http.StatusBadRequest {
+						t.Fatalf("got error %v, want a 400 request error", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !maps.Equal(env, tt.want) {
+					t.Fatalf("got %v, want %v", env, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildEnvDeniesProxyHeader(t *testing.T) {
+	upstream := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7777}
+	for _, tt := range []struct {
+		name string
+		tr   *Transport
+		want string // HTTP_PROXY, if any
+	}{
+		{name: "default", tr: &Transport{}},
+		{name: "allow underscores", tr: &Transport{UnderscoreHeaders: underscoreHeadersAllow}},
+		{name: "other denied headers", tr: &Transport{DenyHeaders: []string{"X-Debug"}}},
+		{
+			name: "env override",
+			tr:   &Transport{EnvVars: map[string]string{"HTTP_PROXY": "http://proxy.internal:3128"}},
+			want: "http://proxy.internal:3128",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTestTransport(t, tt.tr)
+			req := newProxyRequest(http.MethodGet, "/", nil, upstream)
+			req.Header.Set("Proxy", "http://attacker.example:8080")
+
+			env, err := tr.buildEnv(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := env["HTTP_PROXY"]
+			if tt.want == "" && ok {
+				t.Errorf("got HTTP_PROXY %q from the Proxy header", got)
+			} else if got != tt.want {
+				t.Errorf("got HTTP_PROXY %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildEnvDenyHeaders(t *testing.T) {
+	upstream := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7777}
+	for _, name := range []string{"X-Debug", "x-debug", "HTTP_X_DEBUG"} {
+		t.Run(name, func(t *testing.T) {
+			tr := newTestTransport(t, &Transport{DenyHeaders: []string{name}})
+			req := newProxyRequest(http.MethodGet, "/", nil, upstream)
+			req.Header.Set("X-Debug", "1")
+			req.Header.Set("X-Other", "1")
+
+			env, err := tr.buildEnv(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, ok := env["HTTP_X_DEBUG"]; ok {
+				t.Errorf("got HTTP_X_DEBUG %q, want it denied", v)
+			}
+			if _, ok := env["HTTP_X_OTHER"]; !ok {
+				t.Error("HTTP_X_OTHER was denied too")
+			}
+		})
+	}
+}
+
+func BenchmarkBuildEnv(b *testing.B) {
+	tr := newTestTransport(b, &Transport{
+		SplitPath: []string{".php"},
+		EnvVars:   map[string]string{"APP_ENV": "production"},
+	})
+	upstream := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7777}
+	req := newProxyRequest(http.MethodGet, "/index.php/info?a=1", nil, upstream)
+	for _, field := range []string{
+		"Accept", "Accept-Encoding", "Accept-Language", "Cache-Control", "Cookie",
+		"Referer", "Sec-Fetch-Mode", "User-Agent", "X-Forwarded-For", "X-Forwarded-Proto",
+	} {
+		req.Header.Set(field, "value")
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := tr.buildEnv(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestProvisionRejectsPoolWithConnLimit(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	tr := &Transport{ConnPool: &ConnPool{}, MaxConnsPerUpstream: 4}
+	if err := tr.Provision(ctx); err == nil {
+		tr.Cleanup()
+		t.Fatal("conn_pool with max_conns_per_upstream was accepted")
+	}
+}
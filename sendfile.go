@@ -0,0 +1,134 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/fileserver"
+)
+
+// newSendfileServer returns a file server that serves
+// files named by sendfile responses from root.
+func newSendfileServer(ctx caddy.Context, root string) (*fileserver.FileServer, error) {
+	canonicalURIs := false
+	fsrv := &fileserver.FileServer{
+		Root:          root,
+		IndexNames:    []string{}, // only ever serve the named file
+		CanonicalURIs: &canonicalURIs,
+	}
+	if err := fsrv.Provision(ctx); err != nil {
+		return nil, err
+	}
+	return fsrv, nil
+}
+
+// sendfilePath returns the path of the file named by the X-Sendfile or
+// X-Accel-Redirect header of resp, relative to root. X-Sendfile holds a
+// file system path, which must be within root if absolute; X-Accel-Redirect
+// holds a URI path, as with nginx.
+func sendfilePath(resp *http.Response, root string) (string, bool, error) {
+	if name := resp.Header.Get("X-Sendfile"); name != "" {
+		if !filepath.IsAbs(name) {
+			return name, true, nil
+		}
+		rel, err := filepath.Rel(root, filepath.Clean(name))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", true, caddyhttp.Error(http.StatusForbidden,
+				fmt.Errorf("X-Sendfile path outside of sendfile root: %s", name))
+		}
+		return filepath.ToSlash(rel), true, nil
+	}
+
+	if uri := resp.Header.Get("X-Accel-Redirect"); uri != "" {
+		uri, _, _ = strings.Cut(uri, "?")
+		name, err := url.PathUnescape(uri)
+		if err != nil {
+			return "", true, fmt.Errorf("parsing X-Accel-Redirect: %v", err)
+		}
+		return name, true, nil
+	}
+
+	return "", false, nil
+}
+
+// sendfile serves the file at name, relative to the sendfile root, in place
+// of the upstream response resp, whose body must already be closed. The
+// request's method, Range and conditional headers apply to the file, and
+// the upstream's response headers are kept unless the file server sets them.
+func (t Transport) sendfile(r *http.Request, resp *http.Response, name string) (*http.Response, error) {
+	if c := t.logger.Check(zapcore.DebugLevel, "serving sendfile response"); c != nil {
+		c.Write(zap.String("file", name))
+	}
+
+	header := resp.Header.Clone()
+	for _, field := range []string{
+		"X-Sendfile", "X-Accel-Redirect",
+		"Status", "Content-Length", "Content-Range", "Content-Encoding", "Transfer-Encoding",
+		"Etag", "Last-Modified", "Accept-Ranges",
+	} {
+		header.Del(field)
+	}
+
+	req := r.Clone(r.Context())
+	if req.Method != http.MethodHead {
+		req.Method = http.MethodGet
+	}
+	req.URL.Path = "/" + strings.TrimPrefix(name, "/")
+	req.URL.RawPath = ""
+	req.Body = http.NoBody
+	req.ContentLength = 0
+
+	fileResp, err := serveResponseWithHeader(req, header, func(w http.ResponseWriter) error {
+		return t.fileServer.ServeHTTP(w, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("sendfile not found: %s", name))
+		}))
+	})
+	if err != nil {
+		return t.sendfileFailed(r, err)
+	}
+	return fileResp, nil
+}
+
+// sendfileFailed returns a response to r with the status of err if it is a
+// caddyhttp.HandlerError, e.g. 403 for a path outside of the sendfile root
+// or 404 for a missing file. The upstream responded as it should, so the
+// reverse proxy mustn't count these as failures of the upstream.
+func (t Transport) sendfileFailed(r *http.Request, err error) (*http.Response, error) {
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) {
+		return nil, err
+	}
+
+	status := handlerErr.StatusCode
+	level := zapcore.WarnLevel
+	if status >= 500 {
+		level = zapcore.ErrorLevel
+	}
+	if c := t.logger.Check(level, "cannot serve sendfile response"); c != nil {
+		c.Write(zap.Int("status", status), zap.Error(err))
+	}
+	return statusResponse(r, status), nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoundTripSendfile(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		header     string
+		rangeHdr   string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "relative", header: "X-Sendfile: file.txt", wantStatus: http.StatusOK, wantBody: "0123456789"},
+		{name: "absolute within root", header: "X-Sendfile: " + filepath.Join(root, "file.txt"), wantStatus: http.StatusOK, wantBody: "0123456789"},
+		{name: "absolute outside of root", header: "X-Sendfile: " + filepath.Join(dir, "secret.txt"), wantStatus: http.StatusForbidden},
+		{name: "absolute traversal", header: "X-Sendfile: " + root + "/../secret.txt", wantStatus: http.StatusForbidden},
+		{name: "relative traversal", header: "X-Sendfile: ../secret.txt", wantStatus: http.StatusNotFound},
+		{name: "accel traversal", header: "X-Accel-Redirect: /%2e%2e/secret.txt", wantStatus: http.StatusNotFound},
+		{name: "missing", header: "X-Sendfile: missing.txt", wantStatus: http.StatusNotFound},
+		{name: "range", header: "X-Accel-Redirect: /file.txt", rangeHdr: "bytes=2-4", wantStatus: http.StatusPartialContent, wantBody: "234"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newRawServer(t, tt.header+"\r\nContent-Length: 0\r\n\r\n")
+			tr := newTestTransport(t, &Transport{SendfileRoot: root})
+
+			req := newProxyRequest(http.MethodGet, "/download", nil, upstream)
+			if tt.rangeHdr != "" {
+				req.Header.Set("Range", tt.rangeHdr)
+			}
+
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("got error %v, want a %d response", err, tt.wantStatus)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("got body %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
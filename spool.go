@@ -0,0 +1,115 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// spoolMemoryLimit is the number of bytes of a request body that are
+// held in memory before spooling continues into a temporary file.
+const spoolMemoryLimit = 1 << 20
+
+// errBodyTooLarge is returned when a spooled request body
+// exceeds the maximum size.
+var errBodyTooLarge = errors.New("request body too large to spool")
+
+// spoolBufPool holds the memory buffers of spooled bodies. These grow up
+// to spoolMemoryLimit, so they are kept apart from the small buffers
+// the client encodes headers into.
+var spoolBufPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// spooledBody is a request body of previously unknown length that has
+// been read in full so that its length can be sent as CONTENT_LENGTH.
+type spooledBody struct {
+	io.Reader
+	buf  *bytes.Buffer
+	file *os.File
+	size int64
+}
+
+// spoolBody reads body until EOF, keeping up to spoolMemoryLimit bytes
+// in memory and writing the remainder to a temporary file. Bodies larger
+// than maxSize are rejected with errBodyTooLarge.
+func spoolBody(body io.Reader, maxSize int64) (*spooledBody, error) {
+	s := &spooledBody{buf: spoolBufPool.Get().(*bytes.Buffer)}
+	s.buf.Reset()
+
+	n, err := io.CopyN(s.buf, body, min(spoolMemoryLimit, maxSize)+1)
+	if err == io.EOF {
+		s.Reader = s.buf
+		s.size = n
+		return s, nil
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("spooling request body: %v", err)
+	}
+	if n > maxSize {
+		s.Close()
+		return nil, errBodyTooLarge
+	}
+
+	s.file, err = os.CreateTemp("", "caddy-scgi-*")
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("creating spool file: %v", err)
+	}
+
+	if _, err = s.buf.WriteTo(s.file); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("spooling request body: %v", err)
+	}
+	m, err := io.Copy(s.file, io.LimitReader(body, maxSize-n+1))
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("spooling request body: %v", err)
+	}
+	if n+m > maxSize {
+		s.Close()
+		return nil, errBodyTooLarge
+	}
+
+	if _, err = s.file.Seek(0, io.SeekStart); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("rewinding spool file: %v", err)
+	}
+	s.Reader = s.file
+	s.size = n + m
+
+	return s, nil
+}
+
+// Close releases the memory buffer and removes the temporary file, if any.
+func (s *spooledBody) Close() error {
+	spoolBufPool.Put(s.buf)
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if rmErr := os.Remove(s.file.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
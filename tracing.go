@@ -0,0 +1,101 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer of the SCGI transport's spans.
+const tracerName = "github.com/Elegant996/scgi-transport"
+
+// Events added to the span of an exchange with the SCGI server.
+const (
+	eventDialed        = "dialed"
+	eventHeaderWritten = "header written"
+	eventBodyWritten   = "body written"
+	eventFirstByte     = "first byte"
+)
+
+// startSpan starts the span of an exchange with the SCGI server at address
+// as a child of the span in ctx. The span is created by the same tracer
+// provider as its parent, so it is not recorded unless tracing is enabled.
+func startSpan(ctx context.Context, r *http.Request, network, address string) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, "scgi "+r.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("network.transport", network),
+			attribute.String("server.address", address),
+		),
+	)
+}
+
+// endSpan ends span, recording err if the exchange failed.
+func endSpan(span trace.Span, status int, err error) {
+	if status > 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// exchangeTrace returns the client trace of an exchange with the SCGI
+// server, which adds its events to span and times them in stats.
+func exchangeTrace(span trace.Span, stats *exchangeStats) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		WroteHeaders: func() {
+			span.AddEvent(eventHeaderWritten)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			stats.writeDuration = time.Since(stats.writeStart)
+			span.AddEvent(eventBodyWritten)
+		},
+		GotFirstResponseByte: func() {
+			stats.ttfb = time.Since(stats.writeStart)
+			span.AddEvent(eventFirstByte)
+		},
+	}
+}
+
+// injectTraceContext sets HTTP_TRACEPARENT and HTTP_TRACESTATE in env to
+// the W3C trace context of ctx, if any, overriding what the client sent.
+func injectTraceContext(ctx context.Context, env envVars) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	delete(env, "HTTP_TRACESTATE")
+	for key, value := range carrier {
+		env["HTTP_"+headerNameReplacer.Replace(strings.ToUpper(key))] = value
+	}
+}
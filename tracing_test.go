@@ -0,0 +1,59 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scgi
+
+import (
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRoundTripReplacesTraceContext(t *testing.T) {
+	var gotParent, gotState string
+	l := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotParent = r.Header.Get("Traceparent")
+		gotState = r.Header.Get("Tracestate")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tr := newTestTransport(t, &Transport{})
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	active := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	req := newProxyRequest(http.MethodGet, "/", nil, l.Addr())
+	req = req.WithContext(trace.ContextWithSpanContext(req.Context(), active))
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Set("Tracestate", "spoofed=1")
+
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// without a recording tracer, the exchange's span carries the active context
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"; gotParent != want {
+		t.Errorf("got traceparent %q, want %q", gotParent, want)
+	}
+	if gotState != "" {
+		t.Errorf("got tracestate %q, want the client's to be dropped", gotState)
+	}
+}